@@ -0,0 +1,237 @@
+package nsqmiddleware
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// BatchHandlerFunc handles a batch of messages. Returning nil finishes every message, returning a
+// *BatchError responds to every message according to its own error, and returning any other error
+// responds to every message with it: a permanent error finishes them, other errors requeue them.
+// Messages a *BatchError has no entry for are requeued.
+type BatchHandlerFunc func(topic, channel string, messages []*nsq.Message) error
+
+// BatchError reports the result of every message of a batch.
+type BatchError struct {
+	// Errors holds the error of every message, in batch order. Nil errors are successes.
+	Errors []error
+}
+
+func (err *BatchError) Error() string {
+	failed := 0
+	for _, itemErr := range err.Errors {
+		if itemErr != nil {
+			failed++
+		}
+	}
+	return fmt.Sprintf("nsqm: %d of %d messages failed", failed, len(err.Errors))
+}
+
+// Batcher is a nsq.Handler that accumulates messages and hands them to Handler in batches of up to Size
+// messages, or of the messages received within Timeout of the first one. It disables the auto-response
+// of every message: successes are finished, permanent failures are finished and other failures are requeued
+// with RequeueDelay. Messages are touched every TouchInterval while they wait and while their batch is handled.
+//
+// The MaxInFlight of the consumer must be at least Size, otherwise batches only fill up to MaxInFlight
+// and are handled on Timeout.
+//
+// Batches handled on Timeout run outside of any NSQM, so a panic of Handler is recovered by Batcher:
+// it is logged to Logger and every message of the batch is requeued.
+type Batcher struct {
+	Logger  ILogger
+	Handler BatchHandlerFunc
+	Size    int
+	Timeout time.Duration
+	// TouchInterval is how often waiting messages are touched. Zero disables touching.
+	TouchInterval time.Duration
+	// RequeueDelay is the delay of failed messages. -1 lets go-nsq compute it from the number of attempts.
+	RequeueDelay time.Duration
+
+	topic   string
+	channel string
+
+	mu      sync.Mutex
+	pending []*nsq.Message
+	flushed chan struct{}
+}
+
+// NewBatcher returns a new Batcher handling the messages of topic and channel in batches of up to size messages,
+// waiting up to timeout for a batch to fill.
+func NewBatcher(topic, channel string, size int, timeout time.Duration, handler BatchHandlerFunc) *Batcher {
+	return &Batcher{
+		Logger:        log.New(os.Stdout, "[nsqm] ", 0),
+		Handler:       handler,
+		Size:          size,
+		Timeout:       timeout,
+		TouchInterval: 30 * time.Second,
+		RequeueDelay:  -1,
+		topic:         topic,
+		channel:       channel,
+	}
+}
+
+// HandleMessage adds message to the pending batch. When the batch is full, it is handled right away,
+// blocking the calling goroutine.
+func (batcher *Batcher) HandleMessage(message *nsq.Message) error {
+	message.DisableAutoResponse()
+
+	batcher.mu.Lock()
+	batcher.pending = append(batcher.pending, message)
+	if len(batcher.pending) == 1 {
+		batcher.flushed = make(chan struct{})
+		go batcher.wait(batcher.flushed)
+	}
+
+	var batch []*nsq.Message
+	if len(batcher.pending) >= batcher.Size {
+		batch = batcher.take()
+	}
+	batcher.mu.Unlock()
+
+	if batch != nil {
+		batcher.process(batch)
+	}
+	return nil
+}
+
+// Flush handles the pending batch right away, e.g. before stopping the consumer.
+func (batcher *Batcher) Flush() {
+	batcher.mu.Lock()
+	batch := batcher.take()
+	batcher.mu.Unlock()
+
+	if len(batch) > 0 {
+		batcher.process(batch)
+	}
+}
+
+// take must be called with the lock held.
+func (batcher *Batcher) take() []*nsq.Message {
+	batch := batcher.pending
+	batcher.pending = nil
+	if batcher.flushed != nil {
+		close(batcher.flushed)
+		batcher.flushed = nil
+	}
+	return batch
+}
+
+// wait touches the pending batch and handles it on Timeout, unless it was taken before.
+func (batcher *Batcher) wait(flushed chan struct{}) {
+	timer := time.NewTimer(batcher.Timeout)
+	defer timer.Stop()
+
+	tick, stop := batcher.ticker()
+	defer stop()
+
+	for {
+		select {
+		case <-flushed:
+			return
+		case <-tick:
+			batcher.mu.Lock()
+			touch(batcher.pending)
+			batcher.mu.Unlock()
+		case <-timer.C:
+			batcher.mu.Lock()
+			select {
+			case <-flushed:
+				batcher.mu.Unlock()
+				return
+			default:
+			}
+			batch := batcher.take()
+			batcher.mu.Unlock()
+
+			batcher.process(batch)
+			return
+		}
+	}
+}
+
+func (batcher *Batcher) process(batch []*nsq.Message) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	defer wg.Wait()
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		tick, stop := batcher.ticker()
+		defer stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick:
+				touch(batch)
+			}
+		}
+	}()
+
+	err := batcher.handle(batch)
+
+	var batchErr *BatchError
+	ok := errors.As(err, &batchErr)
+	for i, message := range batch {
+		itemErr := err
+		if ok {
+			// Messages with no result are failures, so they are never finished unprocessed.
+			itemErr = batchErr
+			if i < len(batchErr.Errors) {
+				itemErr = batchErr.Errors[i]
+			}
+		}
+
+		if message.HasResponded() {
+			continue
+		}
+		if itemErr == nil || IsPermanent(itemErr) {
+			message.Finish()
+		} else {
+			message.Requeue(batcher.RequeueDelay)
+		}
+	}
+}
+
+// handle calls Handler, turning a panic into a *PanicError.
+func (batcher *Batcher) handle(batch []*nsq.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+			if batcher.Logger != nil {
+				batcher.Logger.Printf(panicText, r, panicErr.Stack)
+			}
+			err = panicErr
+		}
+	}()
+
+	return batcher.Handler(batcher.topic, batcher.channel, batch)
+}
+
+// ticker returns a channel ticking every TouchInterval, or nil if touching is disabled, and its stop function.
+func (batcher *Batcher) ticker() (<-chan time.Time, func()) {
+	if batcher.TouchInterval <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(batcher.TouchInterval)
+	return ticker.C, ticker.Stop
+}
+
+func touch(messages []*nsq.Message) {
+	for _, message := range messages {
+		if !message.HasResponded() {
+			message.Touch()
+		}
+	}
+}
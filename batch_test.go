@@ -0,0 +1,137 @@
+package nsqmiddleware
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestBatcher(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int
+
+	batcher := NewBatcher(defaultTopic, defaultChannel, 3, 20*time.Millisecond, func(topic, channel string, messages []*nsq.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		sizes = append(sizes, len(messages))
+		return &BatchError{Errors: []error{nil, errors.New("error"), Permanent(errors.New("error"))}}
+	})
+
+	var delegates []*mockDelegate
+	for i := 0; i < 4; i++ {
+		message, delegate := newMockMessage(`{"message": 1}`)
+		delegates = append(delegates, delegate)
+		if err := batcher.HandleMessage(message); err != nil {
+			t.Errorf("Batcher.HandleMessage() error = %v", err)
+		}
+	}
+
+	// The first batch is full, the second one is handled on timeout.
+	time.Sleep(50 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sizes) != 2 || sizes[0] != 3 || sizes[1] != 1 {
+		t.Errorf("batch sizes = %v, want [3 1]", sizes)
+	}
+
+	// The full batch was handled by the third HandleMessage call, so its responses are visible here.
+	if delegates[0].finished != 1 || delegates[1].requeued != 1 || delegates[2].finished != 1 {
+		t.Errorf("messages must be responded to per item. got: %+v %+v %+v", delegates[0], delegates[1], delegates[2])
+	}
+}
+
+func TestBatcher_Error(t *testing.T) {
+	batcher := NewBatcher(defaultTopic, defaultChannel, 10, time.Minute, func(topic, channel string, messages []*nsq.Message) error {
+		return errors.New("error")
+	})
+
+	message1, delegate1 := newMockMessage(`{"message": 1}`)
+	message2, delegate2 := newMockMessage(`{"message": 2}`)
+	batcher.HandleMessage(message1)
+	batcher.HandleMessage(message2)
+	batcher.Flush()
+
+	if delegate1.requeued != 1 || delegate2.requeued != 1 {
+		t.Errorf("every message must be requeued. got: %+v %+v", delegate1, delegate2)
+	}
+}
+
+func TestBatcher_MissingResult(t *testing.T) {
+	batcher := NewBatcher(defaultTopic, defaultChannel, 10, time.Minute, func(topic, channel string, messages []*nsq.Message) error {
+		return &BatchError{Errors: []error{nil}}
+	})
+
+	message1, delegate1 := newMockMessage(`{"message": 1}`)
+	message2, delegate2 := newMockMessage(`{"message": 2}`)
+	batcher.HandleMessage(message1)
+	batcher.HandleMessage(message2)
+	batcher.Flush()
+
+	if delegate1.finished != 1 || delegate2.requeued != 1 || delegate2.finished != 0 {
+		t.Errorf("messages with no result must be requeued. got: %+v %+v", delegate1, delegate2)
+	}
+}
+
+// responseDelegate reports the responses sent for a message, for messages responded to on another goroutine.
+type responseDelegate chan string
+
+func (d responseDelegate) OnFinish(message *nsq.Message) { d <- "finish" }
+func (d responseDelegate) OnTouch(message *nsq.Message)  {}
+func (d responseDelegate) OnRequeue(message *nsq.Message, delay time.Duration, backoff bool) {
+	d <- "requeue"
+}
+
+func TestBatcher_Panic(t *testing.T) {
+	batcher := NewBatcher(defaultTopic, defaultChannel, 10, 5*time.Millisecond, func(topic, channel string, messages []*nsq.Message) error {
+		panic("batch")
+	})
+	batcher.Logger = log.New(io.Discard, "", 0)
+
+	responses := make(responseDelegate, 1)
+	message := nsq.NewMessage(nsq.MessageID{'t', 'e', 's', 't'}, []byte(`{"message": 1}`))
+	message.Delegate = responses
+	batcher.HandleMessage(message)
+
+	// The batch is handled on timeout, on the timer goroutine: a panic there would crash the test binary.
+	select {
+	case response := <-responses:
+		if response != "requeue" {
+			t.Errorf("messages of a panicking batch must be requeued. got: %s", response)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("batch must be handled on timeout")
+	}
+}
+
+func TestBatcher_Touch(t *testing.T) {
+	release := make(chan struct{})
+	batcher := NewBatcher(defaultTopic, defaultChannel, 2, time.Minute, func(topic, channel string, messages []*nsq.Message) error {
+		<-release
+		return nil
+	})
+	batcher.TouchInterval = 5 * time.Millisecond
+
+	message, delegate := newMockMessage(`{"message": 1}`)
+	batcher.HandleMessage(message)
+	time.Sleep(30 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		batcher.Flush()
+		close(done)
+	}()
+	time.Sleep(30 * time.Millisecond)
+	close(release)
+	<-done
+
+	if delegate.touched < 2 || delegate.finished != 1 {
+		t.Errorf("message must be touched while waiting and handled. got: %+v", delegate)
+	}
+}
@@ -0,0 +1,287 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrCircuitOpen is returned by CircuitBreaker for messages it requeues without calling the next handler.
+var ErrCircuitOpen = errors.New("nsqm: circuit breaker is open")
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState uint32
+
+// These are the different circuit states.
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (state CircuitState) String() string {
+	switch state {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type circuitBreakerMetrics struct {
+	state       *prometheus.GaugeVec
+	transitions *prometheus.CounterVec
+}
+
+func newCircuitBreakerMetrics(config *prometheusConfig) *circuitBreakerMetrics {
+	return &circuitBreakerMetrics{
+		state: prometheus.NewGaugeVec(prometheus.GaugeOpts(config.opts("circuit_breaker", "state",
+			"The state of the circuit breaker, partitioned by name: 0 closed, 1 open, 2 half-open.")),
+			[]string{"name"},
+		),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts(config.opts("circuit_breaker", "transitions_total",
+			"How many times the circuit breaker changed state, partitioned by name, from and to.")),
+			[]string{"name", "from", "to"},
+		),
+	}
+}
+
+// CircuitBreaker is a context-aware middleware handler that stops calling the next handler while
+// it is failing. The breaker opens after ConsecutiveFailures failures in a row, or when the failure
+// rate over Window reaches FailureRate. While open, messages are requeued with RequeueDelay.
+// After OpenTimeout the breaker is half-open and lets one message at a time through: failures open it
+// again, HalfOpenSuccesses successes close it.
+//
+// OnStateChange is called on every transition, including the timed transition from open to half-open,
+// so it can be used to pause the consumer, e.g. with consumer.ChangeMaxInFlight(0), and resume it.
+//
+// CircuitBreaker is a prometheus.Collector exposing its state and transitions. Register several breakers
+// with RegisterCollectors or WithCollectors to tell them apart by Name.
+type CircuitBreaker struct {
+	// Name identifies the breaker in metrics.
+	Name string
+	// ConsecutiveFailures opens the breaker after that many failures in a row. Zero disables it.
+	ConsecutiveFailures int
+	// FailureRate opens the breaker when the rate of failures over Window reaches it. Zero disables it.
+	FailureRate float64
+	// MinRequests is the number of messages needed in Window before FailureRate applies.
+	MinRequests int
+	Window      time.Duration
+	OpenTimeout time.Duration
+	// HalfOpenSuccesses is the number of successes needed to close a half-open breaker.
+	HalfOpenSuccesses int
+	RequeueDelay      time.Duration
+	// IsFailure classifies errors. Defaults to any error that is not permanent,
+	// since permanent errors are caused by the message rather than by the downstream.
+	IsFailure     func(err error) bool
+	OnStateChange func(from, to CircuitState)
+
+	mu          sync.Mutex
+	state       CircuitState
+	epoch       uint64
+	timer       *time.Timer
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	consecutive int
+	probes      int
+	successes   int
+	pending     [][2]CircuitState
+	metrics     atomic.Pointer[circuitBreakerMetrics]
+}
+
+// NewCircuitBreaker returns a new, closed CircuitBreaker that opens after consecutiveFailures
+// failures in a row and probes again after openTimeout.
+func NewCircuitBreaker(name string, consecutiveFailures int, openTimeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Name:                name,
+		ConsecutiveFailures: consecutiveFailures,
+		MinRequests:         10,
+		Window:              time.Minute,
+		OpenTimeout:         openTimeout,
+		HalfOpenSuccesses:   1,
+		RequeueDelay:        openTimeout,
+	}
+}
+
+func (breaker *CircuitBreaker) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	epoch, ok := breaker.allow()
+	if !ok {
+		message.RequeueWithoutBackoff(breaker.RequeueDelay)
+		return ErrCircuitOpen
+	}
+
+	// A panic counts as a failure, so a panicking probe does not leave the breaker half-open for good.
+	failure := true
+	defer func() {
+		breaker.record(epoch, failure)
+	}()
+
+	err := next(ctx, message)
+	failure = breaker.isFailure(err)
+	return err
+}
+
+// State returns the current state of the breaker.
+func (breaker *CircuitBreaker) State() CircuitState {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	return breaker.state
+}
+
+// allow reports whether a message can go through, along with the epoch of the state that admitted it.
+func (breaker *CircuitBreaker) allow() (uint64, bool) {
+	breaker.mu.Lock()
+	defer breaker.unlock()
+
+	if breaker.state == CircuitOpen && time.Since(breaker.openedAt) >= breaker.OpenTimeout {
+		breaker.setState(CircuitHalfOpen)
+	}
+
+	switch breaker.state {
+	case CircuitOpen:
+		return breaker.epoch, false
+	case CircuitHalfOpen:
+		if breaker.probes > 0 {
+			return breaker.epoch, false
+		}
+		breaker.probes++
+	}
+	return breaker.epoch, true
+}
+
+// record counts the result of a message admitted by allow in epoch. Results of messages admitted
+// before the last transition are ignored, so a slow message admitted while closed is not taken for a probe.
+func (breaker *CircuitBreaker) record(epoch uint64, failure bool) {
+	breaker.mu.Lock()
+	defer breaker.unlock()
+
+	if epoch != breaker.epoch {
+		return
+	}
+
+	switch breaker.state {
+	case CircuitHalfOpen:
+		breaker.probes--
+		if failure {
+			breaker.setState(CircuitOpen)
+			return
+		}
+		breaker.successes++
+		if breaker.successes >= breaker.HalfOpenSuccesses {
+			breaker.setState(CircuitClosed)
+		}
+	case CircuitClosed:
+		now := time.Now()
+		if now.Sub(breaker.windowStart) >= breaker.Window {
+			breaker.windowStart, breaker.requests, breaker.failures = now, 0, 0
+		}
+
+		breaker.requests++
+		if !failure {
+			breaker.consecutive = 0
+			return
+		}
+		breaker.failures++
+		breaker.consecutive++
+
+		if breaker.ConsecutiveFailures > 0 && breaker.consecutive >= breaker.ConsecutiveFailures {
+			breaker.setState(CircuitOpen)
+		} else if breaker.FailureRate > 0 && breaker.requests >= breaker.MinRequests &&
+			float64(breaker.failures)/float64(breaker.requests) >= breaker.FailureRate {
+			breaker.setState(CircuitOpen)
+		}
+	}
+}
+
+// setState must be called with the lock held. Callbacks run once the lock is released.
+func (breaker *CircuitBreaker) setState(state CircuitState) {
+	if breaker.state == state {
+		return
+	}
+
+	breaker.pending = append(breaker.pending, [2]CircuitState{breaker.state, state})
+	breaker.state = state
+	breaker.epoch++
+	breaker.requests, breaker.failures, breaker.consecutive = 0, 0, 0
+	breaker.probes, breaker.successes = 0, 0
+	breaker.windowStart = time.Now()
+
+	if breaker.timer != nil {
+		breaker.timer.Stop()
+		breaker.timer = nil
+	}
+
+	if state == CircuitOpen {
+		breaker.openedAt = time.Now()
+		breaker.timer = time.AfterFunc(breaker.OpenTimeout, breaker.halfOpen)
+	}
+}
+
+func (breaker *CircuitBreaker) halfOpen() {
+	breaker.mu.Lock()
+	defer breaker.unlock()
+
+	if breaker.state == CircuitOpen {
+		breaker.setState(CircuitHalfOpen)
+	}
+}
+
+// unlock releases the lock and reports the transitions made while it was held.
+func (breaker *CircuitBreaker) unlock() {
+	pending := breaker.pending
+	breaker.pending = nil
+	breaker.mu.Unlock()
+
+	metrics := loadMetrics(&breaker.metrics, newCircuitBreakerMetrics)
+	for _, transition := range pending {
+		metrics.state.WithLabelValues(breaker.Name).Set(float64(transition[1]))
+		metrics.transitions.WithLabelValues(breaker.Name, transition[0].String(), transition[1].String()).Inc()
+		if breaker.OnStateChange != nil {
+			breaker.OnStateChange(transition[0], transition[1])
+		}
+	}
+}
+
+func (breaker *CircuitBreaker) isFailure(err error) bool {
+	if breaker.IsFailure != nil {
+		return breaker.IsFailure(err)
+	}
+	return err != nil && !IsPermanent(err)
+}
+
+func (breaker *CircuitBreaker) shareMetrics(config *prometheusConfig) error {
+	metrics := newCircuitBreakerMetrics(config)
+	if err := shareCollector(config.registerer, &metrics.state); err != nil {
+		return err
+	}
+	if err := shareCollector(config.registerer, &metrics.transitions); err != nil {
+		return err
+	}
+
+	metrics.state.WithLabelValues(breaker.Name).Set(float64(breaker.State()))
+	breaker.metrics.Store(metrics)
+	return nil
+}
+
+func (breaker *CircuitBreaker) Describe(ch chan<- *prometheus.Desc) {
+	metrics := loadMetrics(&breaker.metrics, newCircuitBreakerMetrics)
+	metrics.state.Describe(ch)
+	metrics.transitions.Describe(ch)
+}
+
+func (breaker *CircuitBreaker) Collect(ch chan<- prometheus.Metric) {
+	metrics := loadMetrics(&breaker.metrics, newCircuitBreakerMetrics)
+	metrics.state.WithLabelValues(breaker.Name).Set(float64(breaker.State()))
+	metrics.state.Collect(ch)
+	metrics.transitions.Collect(ch)
+}
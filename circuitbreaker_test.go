@@ -0,0 +1,188 @@
+package nsqmiddleware
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestCircuitBreakerMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	var transitions []string
+
+	breaker := NewCircuitBreaker("downstream", 2, 20*time.Millisecond)
+	breaker.OnStateChange = func(from, to CircuitState) {
+		mu.Lock()
+		defer mu.Unlock()
+		transitions = append(transitions, from.String()+">"+to.String())
+	}
+
+	registry := prometheus.NewRegistry()
+	NewPrometheus(WithRegisterer(registry), WithCollectors(breaker))
+
+	failing := &mockMiddleware{err: errors.New("error")}
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(breaker)
+	nsqMid.UseFunc(func(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+		return failing.HandleMessage(topic, channel, message, next)
+	})
+
+	for i := 0; i < 2; i++ {
+		message, _ := newMockMessage(`{"message": 1}`)
+		nsqMid.HandleMessage(message)
+	}
+
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("State() = %v, want open", breaker.State())
+	}
+
+	message, delegate := newMockMessage(`{"message": 1}`)
+	if err := nsqMid.HandleMessage(message); err != ErrCircuitOpen {
+		t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if delegate.requeued != 1 || delegate.backoff {
+		t.Errorf("message must be requeued without backoff. got: %+v", delegate)
+	}
+
+	// The breaker becomes half-open on its own, so a paused consumer can be resumed.
+	time.Sleep(50 * time.Millisecond)
+	if breaker.State() != CircuitHalfOpen {
+		t.Fatalf("State() = %v, want half-open", breaker.State())
+	}
+
+	failing.err = nil
+	message, _ = newMockMessage(`{"message": 1}`)
+	if err := nsqMid.HandleMessage(message); err != nil {
+		t.Errorf("NSQM.HandleMessage() error = %v", err)
+	}
+
+	if breaker.State() != CircuitClosed {
+		t.Errorf("State() = %v, want closed", breaker.State())
+	}
+
+	mu.Lock()
+	got := strings.Join(transitions, ",")
+	mu.Unlock()
+	if got != "closed>open,open>half-open,half-open>closed" {
+		t.Errorf("transitions = %s", got)
+	}
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	for _, want := range []string{
+		`nsqm_circuit_breaker_state{name="downstream"} 0`,
+		`nsqm_circuit_breaker_transitions_total{from="closed",name="downstream",to="open"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %s", want)
+		}
+	}
+}
+
+func TestCircuitBreaker_FailureRate(t *testing.T) {
+	breaker := NewCircuitBreaker("downstream", 0, time.Minute)
+	breaker.FailureRate = 0.5
+	breaker.MinRequests = 4
+
+	for _, failure := range []bool{false, true, false, true} {
+		breaker.record(0, failure)
+	}
+
+	if breaker.State() != CircuitOpen {
+		t.Errorf("State() = %v, want open", breaker.State())
+	}
+
+	if _, ok := breaker.allow(); ok {
+		t.Errorf("open breaker must not allow messages")
+	}
+}
+
+func TestCircuitBreaker_SlowResult(t *testing.T) {
+	breaker := NewCircuitBreaker("downstream", 1, 10*time.Millisecond)
+
+	slow, _ := breaker.allow()
+	failed, _ := breaker.allow()
+	breaker.record(failed, true)
+
+	time.Sleep(20 * time.Millisecond)
+	probe, ok := breaker.allow()
+	if !ok || breaker.State() != CircuitHalfOpen {
+		t.Fatalf("half-open breaker must allow a probe. state: %v", breaker.State())
+	}
+
+	// The message admitted while closed ends during the probe: it must not count as the probe.
+	breaker.record(slow, false)
+	if breaker.State() != CircuitHalfOpen {
+		t.Errorf("State() = %v, want half-open", breaker.State())
+	}
+	if _, ok := breaker.allow(); ok {
+		t.Errorf("half-open breaker must not allow a second probe")
+	}
+
+	breaker.record(probe, false)
+	if breaker.State() != CircuitClosed {
+		t.Errorf("State() = %v, want closed", breaker.State())
+	}
+}
+
+func TestCircuitBreaker_PanickingProbe(t *testing.T) {
+	breaker := NewCircuitBreaker("downstream", 1, 10*time.Millisecond)
+	recovery := NewRecovery()
+	recovery.Logger = log.New(io.Discard, "", 0)
+
+	panicking := true
+	calls := 0
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.Use(recovery)
+	nsqMid.UseContext(breaker)
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		calls++
+		if panicking {
+			panic("probe")
+		}
+		return nil
+	})
+
+	message, _ := newMockMessage(`{"message": 1}`)
+	nsqMid.HandleMessage(message)
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("State() = %v, want open", breaker.State())
+	}
+
+	// The probe panics: the breaker opens again instead of waiting for its result forever.
+	time.Sleep(20 * time.Millisecond)
+	message, _ = newMockMessage(`{"message": 1}`)
+	nsqMid.HandleMessage(message)
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("State() = %v, want open", breaker.State())
+	}
+
+	panicking = false
+	time.Sleep(20 * time.Millisecond)
+	message, _ = newMockMessage(`{"message": 1}`)
+	if err := nsqMid.HandleMessage(message); err != nil {
+		t.Errorf("NSQM.HandleMessage() error = %v", err)
+	}
+
+	if calls != 3 || breaker.State() != CircuitClosed {
+		t.Errorf("calls = %d, state = %v, want 3, closed", calls, breaker.State())
+	}
+}
+
+func TestCircuitBreaker_PermanentError(t *testing.T) {
+	breaker := NewCircuitBreaker("downstream", 1, time.Minute)
+	breaker.record(0, breaker.isFailure(Permanent(errors.New("error"))))
+
+	if breaker.State() != CircuitClosed {
+		t.Errorf("permanent errors must not open the breaker")
+	}
+}
@@ -0,0 +1,241 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/nsqio/go-nsq"
+)
+
+// Compression is a compression format of message bodies.
+// Formats are detected by the magic bytes their streams start with, so no extra header is needed.
+type Compression uint32
+
+// These are the different compression formats.
+const (
+	CompressionNone Compression = iota
+	CompressionGzip
+	CompressionZstd
+	// CompressionSnappy is the framed snappy format.
+	CompressionSnappy
+)
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+func (compression Compression) String() string {
+	switch compression {
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	default:
+		return "none"
+	}
+}
+
+// The codecs are reused across messages: zstd encoders and decoders are heavy and safe for concurrent use
+// in EncodeAll and DecodeAll, gzip writers and readers are pooled.
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	gzipReaders sync.Pool
+
+	zstdEncoderOnce sync.Once
+	zstdEncoder     *zstd.Encoder
+
+	zstdDecodersMu sync.Mutex
+	zstdDecoders   = map[int64]*zstd.Decoder{}
+)
+
+func sharedZstdEncoder() *zstd.Encoder {
+	zstdEncoderOnce.Do(func() {
+		// NewWriter only fails on invalid options.
+		zstdEncoder, _ = zstd.NewWriter(nil)
+	})
+	return zstdEncoder
+}
+
+// sharedZstdDecoder returns the decoder refusing to decode more than maxSize bytes, zero meaning the zstd default.
+func sharedZstdDecoder(maxSize int64) (*zstd.Decoder, error) {
+	zstdDecodersMu.Lock()
+	defer zstdDecodersMu.Unlock()
+
+	if decoder, ok := zstdDecoders[maxSize]; ok {
+		return decoder, nil
+	}
+
+	options := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if maxSize > 0 {
+		options = append(options, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	}
+	decoder, err := zstd.NewReader(nil, options...)
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoders[maxSize] = decoder
+	return decoder, nil
+}
+
+// DetectCompression returns the compression format of body, or CompressionNone.
+func DetectCompression(body []byte) Compression {
+	switch {
+	case bytes.HasPrefix(body, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(body, zstdMagic):
+		return CompressionZstd
+	case bytes.HasPrefix(body, snappyMagic):
+		return CompressionSnappy
+	default:
+		return CompressionNone
+	}
+}
+
+// CompressBody compresses body with compression.
+func CompressBody(compression Compression, body []byte) ([]byte, error) {
+	var buff bytes.Buffer
+	var writer io.WriteCloser
+
+	switch compression {
+	case CompressionGzip:
+		gw := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(gw)
+		gw.Reset(&buff)
+		writer = gw
+	case CompressionZstd:
+		return sharedZstdEncoder().EncodeAll(body, nil), nil
+	case CompressionSnappy:
+		writer = snappy.NewBufferedWriter(&buff)
+	default:
+		return body, nil
+	}
+
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// DecompressBody detects the compression format of body and decompresses it.
+// Uncompressed bodies are returned untouched. Decompressed bodies larger than maxSize are an error,
+// unless maxSize is zero.
+func DecompressBody(body []byte, maxSize int64) ([]byte, Compression, error) {
+	compression := DetectCompression(body)
+
+	var reader io.Reader
+	switch compression {
+	case CompressionGzip:
+		gr, ok := gzipReaders.Get().(*gzip.Reader)
+		if !ok {
+			gr = new(gzip.Reader)
+		}
+		if err := gr.Reset(bytes.NewReader(body)); err != nil {
+			return nil, compression, err
+		}
+		defer gzipReaders.Put(gr)
+		reader = gr
+	case CompressionZstd:
+		decoder, err := sharedZstdDecoder(maxSize)
+		if err != nil {
+			return nil, compression, err
+		}
+
+		decompressed, err := decoder.DecodeAll(body, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) {
+			return nil, compression, fmt.Errorf("nsqm: decompressed %s body exceeds %d bytes", compression, maxSize)
+		}
+		if err != nil {
+			return nil, compression, err
+		}
+		return decompressed, compression, nil
+	case CompressionSnappy:
+		reader = snappy.NewReader(bytes.NewReader(body))
+	default:
+		return body, compression, nil
+	}
+
+	if maxSize > 0 {
+		reader = io.LimitReader(reader, maxSize+1)
+	}
+
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, compression, err
+	}
+	if maxSize > 0 && int64(len(decompressed)) > maxSize {
+		return nil, compression, fmt.Errorf("nsqm: decompressed %s body exceeds %d bytes", compression, maxSize)
+	}
+	return decompressed, compression, nil
+}
+
+// DecompressDefaultMaxSize is the max decompressed size used by the default Decompress instance.
+var DecompressDefaultMaxSize int64 = 64 << 20
+
+// Decompress is a middleware handler that replaces compressed message bodies by their decompressed
+// content before calling the next handler. Uncompressed bodies pass through untouched, so producers
+// can start compressing gradually. Bodies that cannot be decompressed fail with a permanent error.
+type Decompress struct {
+	// MaxSize is the max size of a decompressed body, protecting from decompression bombs. Zero means unlimited.
+	MaxSize int64
+}
+
+// NewDecompress returns a new Decompress instance with DecompressDefaultMaxSize.
+func NewDecompress() *Decompress {
+	return &Decompress{MaxSize: DecompressDefaultMaxSize}
+}
+
+func (decompress *Decompress) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+	body, _, err := DecompressBody(message.Body, decompress.MaxSize)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	message.Body = body
+	return next(message)
+}
+
+// Compress is a publish middleware handler that compresses bodies of at least MinSize bytes
+// with Compression, so they can be read back by Decompress.
+type Compress struct {
+	Compression Compression
+	// MinSize is the size under which bodies are published uncompressed.
+	MinSize int
+}
+
+// NewCompress returns a new Compress instance compressing bodies of at least 1KB with compression.
+func NewCompress(compression Compression) *Compress {
+	return &Compress{Compression: compression, MinSize: 1024}
+}
+
+func (compress *Compress) HandlePublish(ctx context.Context, publishing *Publishing, next PublishFunc) error {
+	bodies := make([][]byte, len(publishing.Bodies))
+	for i, body := range publishing.Bodies {
+		if len(body) < compress.MinSize {
+			bodies[i] = body
+			continue
+		}
+
+		compressed, err := CompressBody(compress.Compression, body)
+		if err != nil {
+			return err
+		}
+		bodies[i] = compressed
+	}
+
+	publishing.Bodies = bodies
+	return next(ctx, publishing)
+}
@@ -0,0 +1,107 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestCompression(t *testing.T) {
+	body := []byte(strings.Repeat(`{"message": 1}`, 100))
+
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd, CompressionSnappy} {
+		t.Run(compression.String(), func(t *testing.T) {
+			publisher := NewMemoryPublisher()
+			chain := NewProducerChain(publisher, NewCompress(compression))
+			if err := chain.Publish(defaultTopic, body); err != nil {
+				t.Fatalf("ProducerChain.Publish() error = %v", err)
+			}
+
+			published := publisher.Messages()[0].Body
+			if DetectCompression(published) != compression || len(published) >= len(body) {
+				t.Errorf("body must be compressed with %s", compression)
+			}
+
+			var got []byte
+			nsqMid := New(defaultTopic, defaultChannel)
+			nsqMid.Use(NewDecompress())
+			nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+				got = message.Body
+				return nil
+			})
+
+			message, _ := newMockMessage(string(published))
+			if err := nsqMid.HandleMessage(message); err != nil {
+				t.Errorf("NSQM.HandleMessage() error = %v", err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("decompressed body = %s, want %s", got, body)
+			}
+		})
+	}
+}
+
+func TestCompression_Passthrough(t *testing.T) {
+	publisher := NewMemoryPublisher()
+	chain := NewProducerChain(publisher, NewCompress(CompressionGzip))
+	chain.Publish(defaultTopic, []byte(`{"message": 1}`))
+
+	if got := publisher.Messages()[0].Body; string(got) != `{"message": 1}` {
+		t.Errorf("small bodies must not be compressed. got: %s", got)
+	}
+
+	var got []byte
+	message, _ := newMockMessage(`{"message": 1}`)
+	err := NewDecompress().HandleMessage(defaultTopic, defaultChannel, message, func(message *nsq.Message) error {
+		got = message.Body
+		return nil
+	})
+	if err != nil || string(got) != `{"message": 1}` {
+		t.Errorf("uncompressed bodies must pass through. error = %v, body = %s", err, got)
+	}
+}
+
+func TestDecompress_MaxSize(t *testing.T) {
+	compressed, _ := CompressBody(CompressionZstd, bytes.Repeat([]byte("a"), 1000))
+
+	decompress := NewDecompress()
+	decompress.MaxSize = 100
+
+	message, _ := newMockMessage(string(compressed))
+	if err := decompress.HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess); !IsPermanent(err) {
+		t.Errorf("Decompress.HandleMessage() error = %v, want permanent error", err)
+	}
+
+	message, _ = newMockMessage(string(gzipMagic) + "corrupt")
+	if err := decompress.HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess); !IsPermanent(err) {
+		t.Errorf("Decompress.HandleMessage() error = %v, want permanent error", err)
+	}
+}
+
+func TestCompression_Concurrent(t *testing.T) {
+	body := []byte(strings.Repeat(`{"message": 1}`, 100))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		compression := []Compression{CompressionGzip, CompressionZstd, CompressionSnappy}[i%3]
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			compressed, err := CompressBody(compression, body)
+			if err != nil {
+				t.Errorf("CompressBody() error = %v", err)
+				return
+			}
+			got, detected, err := DecompressBody(compressed, 0)
+			if err != nil || detected != compression || !bytes.Equal(got, body) {
+				t.Errorf("DecompressBody() = %s, %s, %v", got, detected, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,190 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+)
+
+// ErrSaturated is returned by ConcurrencyLimit when no capacity is left and the policy does not block.
+var ErrSaturated = errors.New("nsqm: concurrency limit reached")
+
+// KeyFunc extracts the key a middleware partitions its state by.
+type KeyFunc func(topic, channel string, message *nsq.Message) string
+
+// TopicChannelKey is a KeyFunc that partitions by topic and channel.
+func TopicChannelKey(topic, channel string, message *nsq.Message) string {
+	return topic + "/" + channel
+}
+
+// TopicKey is a KeyFunc that partitions by topic only.
+func TopicKey(topic, channel string, message *nsq.Message) string {
+	return topic
+}
+
+// SaturationPolicy decides what a limiting middleware does with a message when it has no capacity left.
+type SaturationPolicy uint32
+
+// These are the different saturation policies.
+const (
+	// SaturationBlock waits for capacity, or for the message context to be canceled.
+	SaturationBlock SaturationPolicy = iota
+	// SaturationRequeue requeues the message without backoff and returns ErrSaturated.
+	SaturationRequeue
+	// SaturationFail returns ErrSaturated, leaving the response to go-nsq or to the outer middleware.
+	SaturationFail
+)
+
+// ConcurrencyLimit is a context-aware middleware handler that caps how many messages run the
+// rest of the chain at once. Capacity is shared by every NSQM the instance is added to and
+// partitioned by Key, so one instance can cap a downstream dependency across several consumers.
+// The capacity of a key is dropped once none of its messages is running or waiting, so keys extracted
+// from message bodies do not accumulate.
+//
+// ConcurrencyLimit is a prometheus.Collector exposing the time spent waiting for capacity.
+type ConcurrencyLimit struct {
+	// Limit is the capacity of each key. It must be positive, messages fail with a permanent error otherwise.
+	Limit int64
+	// Key partitions the capacity. Defaults to TopicChannelKey.
+	Key KeyFunc
+	// Weight is the capacity taken by a message. Defaults to 1.
+	Weight func(topic, channel string, message *nsq.Message) int64
+	// Policy decides what happens when there is no capacity left.
+	Policy SaturationPolicy
+	// RequeueDelay is used by SaturationRequeue.
+	RequeueDelay time.Duration
+
+	mu         sync.Mutex
+	semaphores map[string]*keySemaphore
+	wait       atomic.Pointer[prometheus.HistogramVec]
+}
+
+// keySemaphore is the capacity of a key, along with the number of messages holding or waiting for it.
+type keySemaphore struct {
+	*semaphore.Weighted
+	users int
+}
+
+// NewConcurrencyLimit returns a new ConcurrencyLimit instance allowing limit concurrent messages per topic/channel.
+// It panics if limit is not positive.
+func NewConcurrencyLimit(limit int64) *ConcurrencyLimit {
+	if limit <= 0 {
+		panic("limit must be positive")
+	}
+
+	return &ConcurrencyLimit{
+		Limit:        limit,
+		Key:          TopicChannelKey,
+		Policy:       SaturationBlock,
+		RequeueDelay: time.Second,
+	}
+}
+
+func newConcurrencyWait(config *prometheusConfig) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(config.histogramOpts("concurrency", "wait_milliseconds",
+		"How long messages waited for concurrency capacity, partitioned by topic and channel.",
+		[]float64{1, 10, 100, 1000, 10000}),
+		[]string{"topic", "channel"},
+	)
+}
+
+func (limit *ConcurrencyLimit) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	if limit.Limit <= 0 {
+		return Permanent(fmt.Errorf("nsqm: concurrency limit must be positive, got %d", limit.Limit))
+	}
+
+	key := limit.key(topic, channel, message)
+	sem := limit.semaphore(key)
+	defer limit.leave(key, sem)
+
+	weight := int64(1)
+	if limit.Weight != nil {
+		weight = limit.Weight(topic, channel, message)
+	}
+	if weight > limit.Limit {
+		weight = limit.Limit
+	}
+
+	start := time.Now()
+	switch limit.Policy {
+	case SaturationRequeue:
+		if !sem.TryAcquire(weight) {
+			message.RequeueWithoutBackoff(limit.RequeueDelay)
+			return ErrSaturated
+		}
+	case SaturationFail:
+		if !sem.TryAcquire(weight) {
+			return ErrSaturated
+		}
+	default:
+		if err := sem.Acquire(ctx, weight); err != nil {
+			return err
+		}
+	}
+	defer sem.Release(weight)
+
+	loadMetrics(&limit.wait, newConcurrencyWait).WithLabelValues(topic, channel).Observe(milliseconds(time.Since(start)))
+
+	return next(ctx, message)
+}
+
+func (limit *ConcurrencyLimit) key(topic, channel string, message *nsq.Message) string {
+	if limit.Key == nil {
+		return TopicChannelKey(topic, channel, message)
+	}
+	return limit.Key(topic, channel, message)
+}
+
+// semaphore returns the semaphore of key, creating it if needed. It must be given back with leave.
+func (limit *ConcurrencyLimit) semaphore(key string) *keySemaphore {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+
+	if limit.semaphores == nil {
+		limit.semaphores = map[string]*keySemaphore{}
+	}
+
+	sem, ok := limit.semaphores[key]
+	if !ok {
+		sem = &keySemaphore{Weighted: semaphore.NewWeighted(limit.Limit)}
+		limit.semaphores[key] = sem
+	}
+	sem.users++
+	return sem
+}
+
+// leave drops the semaphore of key once no message uses it anymore.
+func (limit *ConcurrencyLimit) leave(key string, sem *keySemaphore) {
+	limit.mu.Lock()
+	defer limit.mu.Unlock()
+
+	sem.users--
+	if sem.users == 0 {
+		delete(limit.semaphores, key)
+	}
+}
+
+func (limit *ConcurrencyLimit) shareMetrics(config *prometheusConfig) error {
+	wait := newConcurrencyWait(config)
+	if err := shareCollector(config.registerer, &wait); err != nil {
+		return err
+	}
+
+	limit.wait.Store(wait)
+	return nil
+}
+
+func (limit *ConcurrencyLimit) Describe(ch chan<- *prometheus.Desc) {
+	loadMetrics(&limit.wait, newConcurrencyWait).Describe(ch)
+}
+
+func (limit *ConcurrencyLimit) Collect(ch chan<- prometheus.Metric) {
+	loadMetrics(&limit.wait, newConcurrencyWait).Collect(ch)
+}
@@ -0,0 +1,124 @@
+package nsqmiddleware
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	limit := NewConcurrencyLimit(2)
+
+	registry := prometheus.NewRegistry()
+	NewPrometheus(WithRegisterer(registry), WithCollectors(limit))
+
+	var running, maxRunning int32
+	handler := func(message *nsq.Message) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	// Two stacks sharing the same limit and topic/channel share the capacity.
+	stacks := []*NSQM{New(defaultTopic, defaultChannel), New(defaultTopic, defaultChannel)}
+	for _, nsqMid := range stacks {
+		nsqMid.UseContext(limit)
+		nsqMid.UseHandlerFunc(handler)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(nsqMid *NSQM) {
+			defer wg.Done()
+			nsqMid.HandleMessage(&nsq.Message{})
+		}(stacks[i%2])
+	}
+	wg.Wait()
+
+	if maxRunning != 2 {
+		t.Errorf("max concurrent messages = %d, want 2", maxRunning)
+	}
+	if len(limit.semaphores) != 0 {
+		t.Errorf("idle keys must be dropped. got: %d", len(limit.semaphores))
+	}
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if !strings.Contains(body, `nsqm_concurrency_wait_milliseconds_count{channel="channel_test",topic="topic_test"} 10`) {
+		t.Errorf("body does not contain concurrency wait metrics. got: %s", body)
+	}
+}
+
+func TestConcurrencyLimit_Policy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       SaturationPolicy
+		wantRequeued int
+	}{
+		{"requeue", SaturationRequeue, 1},
+		{"fail", SaturationFail, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := NewConcurrencyLimit(1)
+			limit.Policy = tt.policy
+
+			release := make(chan struct{})
+			started := make(chan struct{})
+
+			nsqMid := New(defaultTopic, defaultChannel)
+			nsqMid.UseContext(limit)
+			nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+				close(started)
+				<-release
+				return nil
+			})
+
+			go nsqMid.HandleMessage(&nsq.Message{})
+			<-started
+
+			message, delegate := newMockMessage(`{"message": 1}`)
+			if err := nsqMid.HandleMessage(message); err != ErrSaturated {
+				t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, ErrSaturated)
+			}
+			close(release)
+
+			if delegate.requeued != tt.wantRequeued || delegate.backoff {
+				t.Errorf("requeued = %d, backoff = %v, want %d, false", delegate.requeued, delegate.backoff, tt.wantRequeued)
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimit_NonPositive(t *testing.T) {
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(&ConcurrencyLimit{})
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		t.Errorf("next must not be called without capacity")
+		return nil
+	})
+
+	if err := nsqMid.HandleMessage(&nsq.Message{}); !IsPermanent(err) {
+		t.Errorf("NSQM.HandleMessage() error = %v, want a permanent error", err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("NewConcurrencyLimit(0) must panic")
+		}
+	}()
+	NewConcurrencyLimit(0)
+}
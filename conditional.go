@@ -0,0 +1,65 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Predicate decides whether a message matches a condition.
+type Predicate func(topic, channel string, message *nsq.Message) bool
+
+// AttemptsAbove returns a Predicate matching messages attempted more than attempts times.
+func AttemptsAbove(attempts uint16) Predicate {
+	return func(topic, channel string, message *nsq.Message) bool {
+		return message.Attempts > attempts
+	}
+}
+
+// BodyHasPrefix returns a Predicate matching messages whose body starts with prefix, e.g. magic bytes.
+func BodyHasPrefix(prefix []byte) Predicate {
+	return func(topic, channel string, message *nsq.Message) bool {
+		return bytes.HasPrefix(message.Body, prefix)
+	}
+}
+
+// Chain composes handlers into a single Handler that runs them in order, then yields to the next handler.
+func Chain(handlers ...Handler) Handler {
+	return ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		return runChain(ctx, topic, channel, message, handlers, next)
+	})
+}
+
+func runChain(ctx context.Context, topic, channel string, message *nsq.Message, handlers []Handler, next NextFunc) error {
+	if len(handlers) == 0 {
+		return next(ctx, message)
+	}
+
+	return contextHandler(handlers[0]).HandleMessageContext(ctx, topic, channel, message, func(ctx context.Context, message *nsq.Message) error {
+		return runChain(ctx, topic, channel, message, handlers[1:], next)
+	})
+}
+
+// When returns a Handler that runs handler for messages matching predicate.
+// Other messages go straight to the next handler.
+func When(predicate Predicate, handler Handler) Handler {
+	return Branch(predicate, []Handler{handler}, nil)
+}
+
+// Unless returns a Handler that runs handler for messages not matching predicate.
+// Other messages go straight to the next handler.
+func Unless(predicate Predicate, handler Handler) Handler {
+	return Branch(predicate, nil, []Handler{handler})
+}
+
+// Branch returns a Handler that runs thenChain for messages matching predicate and elseChain for the others.
+// Both chains yield to the next handler once they are done.
+func Branch(predicate Predicate, thenChain, elseChain []Handler) Handler {
+	return ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		if predicate(topic, channel, message) {
+			return runChain(ctx, topic, channel, message, thenChain, next)
+		}
+		return runChain(ctx, topic, channel, message, elseChain, next)
+	})
+}
@@ -0,0 +1,71 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestConditional(t *testing.T) {
+	var got []string
+	record := func(name string) Handler {
+		return HandlerFunc(func(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+			got = append(got, name)
+			return next(message)
+		})
+	}
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.Use(When(AttemptsAbove(3), record("when")))
+	nsqMid.Use(Unless(AttemptsAbove(3), record("unless")))
+	nsqMid.Use(Branch(BodyHasPrefix([]byte("gz:")), []Handler{record("then1"), record("then2")}, []Handler{record("else")}))
+	nsqMid.Use(record("last"))
+
+	tests := []struct {
+		body     string
+		attempts uint16
+		want     string
+	}{
+		{`{"message": 1}`, 1, "unless,else,last"},
+		{`gz:body`, 4, "when,then1,then2,last"},
+	}
+	for _, tt := range tests {
+		got = nil
+
+		message, _ := newMockMessage(tt.body)
+		message.Attempts = tt.attempts
+		if err := nsqMid.HandleMessage(message); err != nil {
+			t.Errorf("NSQM.HandleMessage() error = %v", err)
+		}
+
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("handlers = %v, want %v", got, tt.want)
+		}
+	}
+}
+
+func TestChain_Context(t *testing.T) {
+	var got interface{}
+
+	handler := Chain(
+		ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+			return next(context.WithValue(ctx, ctxKey{}, "value"), message)
+		}),
+		mockMiddleware{},
+	)
+
+	nsqMid := New(defaultTopic, defaultChannel, handler)
+	nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		got = ctx.Value(ctxKey{})
+		return next(ctx, message)
+	})
+
+	if err := nsqMid.HandleMessage(&nsq.Message{}); err != nil {
+		t.Errorf("NSQM.HandleMessage() error = %v", err)
+	}
+	if got != "value" {
+		t.Errorf("context value = %v, want %v", got, "value")
+	}
+}
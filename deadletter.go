@@ -0,0 +1,97 @@
+package nsqmiddleware
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Publisher is the subset of *nsq.Producer used to publish messages.
+type Publisher interface {
+	Publish(topic string, body []byte) error
+}
+
+// DeadLetterMessage is the JSON payload published to the dead-letter topic.
+type DeadLetterMessage struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Channel   string    `json:"channel"`
+	Attempts  uint16    `json:"attempts"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+	FailedAt  time.Time `json:"failed_at"`
+	Body      []byte    `json:"body"`
+}
+
+// DeadLetter is a middleware handler that republishes poison messages to a dead-letter topic
+// and finishes the original. A message is poison when it failed with a permanent error or
+// when it has been attempted MaxAttempts times.
+type DeadLetter struct {
+	Logger    ILogger
+	Publisher Publisher
+	Topic     string
+	// MaxAttempts is the number of attempts after which a failing message is dead-lettered. Zero means never.
+	MaxAttempts uint16
+	// IsPermanent classifies errors. Errors for which it returns true are dead-lettered right away.
+	IsPermanent func(err error) bool
+}
+
+// NewDeadLetter returns a new DeadLetter instance that publishes to topic using publisher.
+func NewDeadLetter(publisher Publisher, topic string) *DeadLetter {
+	return &DeadLetter{
+		Logger:      log.New(os.Stdout, "[nsqm] ", 0),
+		Publisher:   publisher,
+		Topic:       topic,
+		MaxAttempts: RetryDefaultMaxAttempts,
+		IsPermanent: IsPermanent,
+	}
+}
+
+func (deadLetter *DeadLetter) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+	err := next(message)
+	if err == nil || !deadLetter.poison(message, err) {
+		return err
+	}
+
+	if dlErr := deadLetter.Send(topic, channel, message, err); dlErr != nil {
+		deadLetter.Logger.Printf("dead letter failed: %s", dlErr)
+		return err
+	}
+
+	message.Finish()
+	return err
+}
+
+// Send publishes message to the dead-letter topic along with its metadata and err.
+// It has the DeadLetterFunc signature so it can be used by Recovery.
+func (deadLetter *DeadLetter) Send(topic, channel string, message *nsq.Message, err error) error {
+	dlMessage := DeadLetterMessage{
+		ID:        string(message.ID[:]),
+		Topic:     topic,
+		Channel:   channel,
+		Attempts:  message.Attempts,
+		Timestamp: time.Unix(0, message.Timestamp),
+		FailedAt:  time.Now(),
+		Body:      message.Body,
+	}
+	if err != nil {
+		dlMessage.Error = err.Error()
+	}
+
+	body, err := json.Marshal(dlMessage)
+	if err != nil {
+		return err
+	}
+
+	return deadLetter.Publisher.Publish(deadLetter.Topic, body)
+}
+
+func (deadLetter *DeadLetter) poison(message *nsq.Message, err error) bool {
+	if deadLetter.IsPermanent != nil && deadLetter.IsPermanent(err) {
+		return true
+	}
+	return deadLetter.MaxAttempts > 0 && message.Attempts >= deadLetter.MaxAttempts
+}
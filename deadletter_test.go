@@ -0,0 +1,67 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+)
+
+func TestDeadLetterMiddleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     uint16
+		err          error
+		publishErr   error
+		wantFinished int
+		wantDead     int
+	}{
+		{"success", 1, nil, nil, 0, 0},
+		{"retryable", 1, errors.New("error"), nil, 0, 0},
+		{"permanent", 1, Permanent(errors.New("error")), nil, 1, 1},
+		{"out of attempts", 5, errors.New("error"), nil, 1, 1},
+		{"publish error", 5, errors.New("error"), errors.New("publish error"), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := NewMemoryPublisher()
+			publisher.Err = tt.publishErr
+
+			deadLetter := NewDeadLetter(publisher, "dead_letter")
+			deadLetter.Logger = log.New(&bytes.Buffer{}, "", 0)
+
+			message, delegate := newMockMessage(`{"message": 1}`)
+			message.Attempts = tt.attempts
+
+			nsqMid := New(defaultTopic, defaultChannel)
+			nsqMid.Use(deadLetter)
+			nsqMid.Use(mockMiddleware{err: tt.err})
+
+			if err := nsqMid.HandleMessage(message); err != tt.err {
+				t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, tt.err)
+			}
+
+			if delegate.finished != tt.wantFinished {
+				t.Errorf("finished = %d, want %d", delegate.finished, tt.wantFinished)
+			}
+
+			messages := publisher.Messages()
+			if len(messages) != tt.wantDead {
+				t.Fatalf("dead letters = %d, want %d", len(messages), tt.wantDead)
+			}
+
+			for _, m := range messages {
+				var dlMessage DeadLetterMessage
+				if err := json.Unmarshal(m.Body, &dlMessage); err != nil {
+					t.Fatal(err)
+				}
+
+				if m.Topic != "dead_letter" || dlMessage.Topic != defaultTopic || dlMessage.Channel != defaultChannel ||
+					dlMessage.Attempts != tt.attempts || dlMessage.Error != "error" || string(dlMessage.Body) != `{"message": 1}` {
+					t.Errorf("unexpected dead letter: %+v", dlMessage)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encodes and decodes message bodies.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec using encoding/json.
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string                               { return "json" }
+func (JSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// GobCodec is a Codec using encoding/gob. Every body is a self-contained gob stream.
+type GobCodec struct{}
+
+func (GobCodec) Name() string { return "gob" }
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(v); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// MsgpackCodec is a Codec using MessagePack.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string                               { return "msgpack" }
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error)      { return msgpack.Marshal(v) }
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// ProtoCodec is a Codec using protocol buffers. Values must be proto.Message.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Name() string { return "protobuf" }
+
+func (ProtoCodec) Marshal(v interface{}) ([]byte, error) {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("nsqm: %T is not a proto.Message", v)
+	}
+	return proto.Marshal(message)
+}
+
+func (ProtoCodec) Unmarshal(data []byte, v interface{}) error {
+	message, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("nsqm: %T is not a proto.Message", v)
+	}
+	return proto.Unmarshal(data, message)
+}
+
+// DecodeError is returned when a message body cannot be decoded.
+type DecodeError struct {
+	// Codec is the name of the codec that failed.
+	Codec string
+	Err   error
+}
+
+func (err *DecodeError) Error() string {
+	return fmt.Sprintf("nsqm: cannot decode %s body: %s", err.Codec, err.Err)
+}
+
+func (err *DecodeError) Unwrap() error {
+	return err.Err
+}
+
+// DecodePolicy decides what happens to a message whose body cannot be decoded.
+type DecodePolicy uint32
+
+// These are the different decode policies.
+const (
+	// DecodeFail returns the *DecodeError wrapped by Permanent, leaving the response to go-nsq or to the outer middleware.
+	DecodeFail DecodePolicy = iota
+	// DecodeFinish finishes the message and returns nil.
+	DecodeFinish
+	// DecodeDeadLetter passes the message to the DeadLetterFunc and finishes it.
+	// The message is left unanswered if the dead-letter handler fails. The *DecodeError is returned either way.
+	DecodeDeadLetter
+)
+
+// DecodeOption configures a Decode handler.
+type DecodeOption func(*decodeConfig)
+
+type decodeConfig struct {
+	codec      Codec
+	policy     DecodePolicy
+	deadLetter DeadLetterFunc
+}
+
+// WithCodec sets the codec of the bodies. Defaults to JSONCodec.
+func WithCodec(codec Codec) DecodeOption {
+	return func(config *decodeConfig) {
+		config.codec = codec
+	}
+}
+
+// WithDecodePolicy sets what happens to undecodable bodies. Defaults to DecodeFail.
+func WithDecodePolicy(policy DecodePolicy) DecodeOption {
+	return func(config *decodeConfig) {
+		config.policy = policy
+	}
+}
+
+// WithDecodeDeadLetter dead-letters undecodable bodies with deadLetter, e.g. DeadLetter.Send.
+func WithDecodeDeadLetter(deadLetter DeadLetterFunc) DecodeOption {
+	return func(config *decodeConfig) {
+		config.policy = DecodeDeadLetter
+		config.deadLetter = deadLetter
+	}
+}
+
+// Decode converts a handler function of typed values into a nsqm.Handler.
+// The body of every message is decoded into a new T before calling handlerFunc. When T is a pointer type,
+// it points to a new value, so proto messages can be decoded with Decode[*pb.Message].
+// The next NextFunc is automatically called after handlerFunc succeeds.
+func Decode[T any](handlerFunc func(ctx context.Context, topic, channel string, message *nsq.Message, v T) error, options ...DecodeOption) Handler {
+	config := &decodeConfig{codec: JSONCodec{}}
+	for _, option := range options {
+		option(config)
+	}
+
+	return ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		v, err := decode[T](config.codec, message.Body)
+		if err != nil {
+			return config.reject(topic, channel, message, err)
+		}
+
+		if err := handlerFunc(ctx, topic, channel, message, v); err != nil {
+			return err
+		}
+		return next(ctx, message)
+	})
+}
+
+func decode[T any](codec Codec, body []byte) (T, *DecodeError) {
+	var v T
+
+	target := interface{}(&v)
+	if typ := reflect.TypeOf(v); typ != nil && typ.Kind() == reflect.Ptr {
+		ptr := reflect.New(typ.Elem())
+		v = ptr.Interface().(T)
+		target = v
+	}
+
+	if err := codec.Unmarshal(body, target); err != nil {
+		return v, &DecodeError{Codec: codec.Name(), Err: err}
+	}
+	return v, nil
+}
+
+func (config *decodeConfig) reject(topic, channel string, message *nsq.Message, err *DecodeError) error {
+	switch config.policy {
+	case DecodeFinish:
+		message.Finish()
+		return nil
+	case DecodeDeadLetter:
+		if config.deadLetter == nil {
+			return err
+		}
+		if dlErr := config.deadLetter(topic, channel, message, err); dlErr != nil {
+			return err
+		}
+		message.Finish()
+		return err
+	default:
+		return Permanent(err)
+	}
+}
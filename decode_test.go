@@ -0,0 +1,120 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type decodeTestEvent struct {
+	Name  string `json:"name" msgpack:"name"`
+	Count int    `json:"count" msgpack:"count"`
+}
+
+func TestDecode(t *testing.T) {
+	want := decodeTestEvent{Name: "created", Count: 2}
+
+	tests := []struct {
+		name  string
+		codec Codec
+	}{
+		{"json", JSONCodec{}},
+		{"gob", GobCodec{}},
+		{"msgpack", MsgpackCodec{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got decodeTestEvent
+
+			nsqMid := New(defaultTopic, defaultChannel)
+			nsqMid.Use(Decode(func(ctx context.Context, topic, channel string, message *nsq.Message, v decodeTestEvent) error {
+				got = v
+				return nil
+			}, WithCodec(tt.codec)))
+
+			body, err := tt.codec.Marshal(want)
+			if err != nil {
+				t.Fatalf("Codec.Marshal() error = %v", err)
+			}
+
+			message, _ := newMockMessage(string(body))
+			if err := nsqMid.HandleMessage(message); err != nil {
+				t.Errorf("NSQM.HandleMessage() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded value = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestDecode_Proto(t *testing.T) {
+	var got *wrapperspb.StringValue
+
+	handler := Decode(func(ctx context.Context, topic, channel string, message *nsq.Message, v *wrapperspb.StringValue) error {
+		got = v
+		return nil
+	}, WithCodec(ProtoCodec{}))
+
+	body, _ := ProtoCodec{}.Marshal(wrapperspb.String("value"))
+	message, _ := newMockMessage(string(body))
+	if err := handler.HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess); err != nil {
+		t.Errorf("Handler.HandleMessage() error = %v", err)
+	}
+
+	if got.GetValue() != "value" {
+		t.Errorf("decoded value = %v, want %v", got.GetValue(), "value")
+	}
+}
+
+func TestDecode_Policy(t *testing.T) {
+	handlerFunc := func(ctx context.Context, topic, channel string, message *nsq.Message, v decodeTestEvent) error {
+		t.Errorf("handler must not be called for undecodable bodies")
+		return nil
+	}
+
+	t.Run("fail", func(t *testing.T) {
+		message, delegate := newMockMessage(`not json`)
+		err := Decode(handlerFunc).HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess)
+
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) || !IsPermanent(err) {
+			t.Errorf("Handler.HandleMessage() error = %v, want permanent *DecodeError", err)
+		}
+		if decodeErr != nil && decodeErr.Codec != "json" {
+			t.Errorf("DecodeError.Codec = %v, want json", decodeErr.Codec)
+		}
+		if delegate.finished != 0 {
+			t.Errorf("message must not be finished")
+		}
+	})
+
+	t.Run("finish", func(t *testing.T) {
+		message, delegate := newMockMessage(`not json`)
+		err := Decode(handlerFunc, WithDecodePolicy(DecodeFinish)).HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess)
+
+		if err != nil || delegate.finished != 1 {
+			t.Errorf("message must be finished. error = %v, delegate = %+v", err, delegate)
+		}
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+		publisher := NewMemoryPublisher()
+		deadLetter := NewDeadLetter(publisher, "dead")
+
+		message, delegate := newMockMessage(`not json`)
+		err := Decode(handlerFunc, WithDecodeDeadLetter(deadLetter.Send)).HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess)
+
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Errorf("Handler.HandleMessage() error = %v, want *DecodeError", err)
+		}
+		if delegate.finished != 1 || len(publisher.Messages()) != 1 {
+			t.Errorf("message must be dead-lettered and finished. delegate = %+v", delegate)
+		}
+	})
+}
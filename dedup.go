@@ -0,0 +1,163 @@
+package nsqmiddleware
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// DedupStore records the keys of processed messages. Implementations must be safe for concurrent use.
+// A shared store, e.g. backed by Redis, deduplicates across consumer processes.
+type DedupStore interface {
+	// Seen reports whether key has been recorded and has not expired.
+	Seen(ctx context.Context, key string) (bool, error)
+	// Record records key for ttl. Zero means the key never expires.
+	Record(ctx context.Context, key string, ttl time.Duration) error
+}
+
+// MessageIDKey is a KeyFunc that uses the NSQ message ID.
+// IDs are kept by requeues, but a message published twice gets two IDs.
+func MessageIDKey(topic, channel string, message *nsq.Message) string {
+	return string(message.ID[:])
+}
+
+// BodyHashKey is a KeyFunc that uses the SHA-256 of the body, so identical bodies are duplicates.
+func BodyHashKey(topic, channel string, message *nsq.Message) string {
+	sum := sha256.Sum256(message.Body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Dedup is a context-aware middleware handler that skips messages that were already processed.
+// Duplicates are finished without calling the next handler. The key of a message is recorded in
+// Store, partitioned by topic and channel, only when the next handler returns nil.
+//
+// Store errors do not stop processing: they are logged and the message is handled as new.
+// Duplicates handled at the same time by several handlers are not detected.
+type Dedup struct {
+	Logger ILogger
+	Store  DedupStore
+	// Key extracts the key of a message. Defaults to MessageIDKey. Empty keys are never deduplicated.
+	Key KeyFunc
+	// TTL is how long a key is remembered. Zero means for as long as the store keeps it.
+	TTL time.Duration
+}
+
+// NewDedup returns a new Dedup instance keyed by message ID that remembers keys for ttl.
+func NewDedup(store DedupStore, ttl time.Duration) *Dedup {
+	return &Dedup{
+		Logger: log.New(os.Stdout, "[nsqm] ", 0),
+		Store:  store,
+		Key:    MessageIDKey,
+		TTL:    ttl,
+	}
+}
+
+func (dedup *Dedup) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	key := MessageIDKey(topic, channel, message)
+	if dedup.Key != nil {
+		key = dedup.Key(topic, channel, message)
+	}
+	if key == "" {
+		return next(ctx, message)
+	}
+	key = topic + "/" + channel + "/" + key
+
+	seen, err := dedup.Store.Seen(ctx, key)
+	if err != nil {
+		dedup.Logger.Printf("dedup lookup failed: %s", err)
+	} else if seen {
+		message.Finish()
+		return nil
+	}
+
+	if err := next(ctx, message); err != nil {
+		return err
+	}
+
+	if err := dedup.Store.Record(ctx, key, dedup.TTL); err != nil {
+		dedup.Logger.Printf("dedup record failed: %s", err)
+	}
+	return nil
+}
+
+type memoryDedupEntry struct {
+	key     string
+	expires time.Time
+}
+
+// MemoryDedupStore is an in-memory DedupStore that keeps up to size keys,
+// evicting the least recently recorded ones first.
+type MemoryDedupStore struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+// NewMemoryDedupStore returns a new, empty MemoryDedupStore holding up to size keys.
+func NewMemoryDedupStore(size int) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+func (store *MemoryDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	element, ok := store.entries[key]
+	if !ok {
+		return false, nil
+	}
+
+	entry := element.Value.(*memoryDedupEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		store.remove(element)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (store *MemoryDedupStore) Record(ctx context.Context, key string, ttl time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+
+	if element, ok := store.entries[key]; ok {
+		element.Value.(*memoryDedupEntry).expires = expires
+		store.order.MoveToFront(element)
+		return nil
+	}
+
+	store.entries[key] = store.order.PushFront(&memoryDedupEntry{key: key, expires: expires})
+	for store.size > 0 && store.order.Len() > store.size {
+		store.remove(store.order.Back())
+	}
+	return nil
+}
+
+// Len returns the number of keys in the store, including expired keys not evicted yet.
+func (store *MemoryDedupStore) Len() int {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.order.Len()
+}
+
+func (store *MemoryDedupStore) remove(element *list.Element) {
+	store.order.Remove(element)
+	delete(store.entries, element.Value.(*memoryDedupEntry).key)
+}
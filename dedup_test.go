@@ -0,0 +1,105 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestDedupMiddleware(t *testing.T) {
+	calls := 0
+	failing := errors.New("error")
+	var result error
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(NewDedup(NewMemoryDedupStore(10), time.Minute))
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		calls++
+		return result
+	})
+
+	// Failed messages are not recorded.
+	result = failing
+	message, _ := newMockMessage(`{"message": 1}`)
+	if err := nsqMid.HandleMessage(message); err != failing {
+		t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, failing)
+	}
+
+	result = nil
+	message, _ = newMockMessage(`{"message": 1}`)
+	if err := nsqMid.HandleMessage(message); err != nil {
+		t.Errorf("NSQM.HandleMessage() error = %v", err)
+	}
+
+	message, delegate := newMockMessage(`{"message": 1}`)
+	if err := nsqMid.HandleMessage(message); err != nil {
+		t.Errorf("NSQM.HandleMessage() error = %v", err)
+	}
+	if delegate.finished != 1 {
+		t.Errorf("duplicate must be finished. got: %+v", delegate)
+	}
+
+	if calls != 2 {
+		t.Errorf("handler calls = %d, want 2", calls)
+	}
+}
+
+type failingDedupStore struct{}
+
+func (failingDedupStore) Seen(ctx context.Context, key string) (bool, error) {
+	return false, errors.New("store down")
+}
+
+func (failingDedupStore) Record(ctx context.Context, key string, ttl time.Duration) error {
+	return errors.New("store down")
+}
+
+func TestDedup_StoreError(t *testing.T) {
+	buff := &bytes.Buffer{}
+	dedup := NewDedup(failingDedupStore{}, time.Minute)
+	dedup.Logger = log.New(buff, "", 0)
+	dedup.Key = BodyHashKey
+
+	calls := 0
+	message, _ := newMockMessage(`{"message": 1}`)
+	err := dedup.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, message, func(ctx context.Context, message *nsq.Message) error {
+		calls++
+		return nil
+	})
+
+	if err != nil || calls != 1 {
+		t.Errorf("store errors must not stop processing. error = %v, calls = %d", err, calls)
+	}
+	if buff.Len() == 0 {
+		t.Errorf("store errors must be logged")
+	}
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryDedupStore(2)
+
+	store.Record(ctx, "a", 0)
+	store.Record(ctx, "b", time.Millisecond)
+	store.Record(ctx, "c", 0)
+
+	if seen, _ := store.Seen(ctx, "a"); seen {
+		t.Errorf("least recently recorded key must be evicted")
+	}
+	if store.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", store.Len())
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	if seen, _ := store.Seen(ctx, "b"); seen {
+		t.Errorf("expired key must not be seen")
+	}
+	if seen, _ := store.Seen(ctx, "c"); !seen {
+		t.Errorf("recorded key must be seen")
+	}
+}
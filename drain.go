@@ -0,0 +1,129 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// ErrDraining is returned by Drain for messages it refuses once shutdown has begun.
+var ErrDraining = errors.New("nsqm: draining")
+
+// Drain is a context-aware middleware handler that tracks the messages in flight in the rest of the chain.
+// Once Shutdown is called, new messages are requeued without backoff and not passed to the next handler,
+// and Wait returns when the messages in flight are done, so none is dropped half-processed.
+// One instance can be shared by several NSQM to drain them together.
+type Drain struct {
+	// RequeueDelay is the delay of the messages refused during shutdown.
+	RequeueDelay time.Duration
+
+	mu       sync.Mutex
+	inFlight int64
+	draining bool
+	idle     chan struct{}
+}
+
+// NewDrain returns a new Drain instance requeueing refused messages with the default go-nsq delay.
+func NewDrain() *Drain {
+	return &Drain{RequeueDelay: -1}
+}
+
+func (drain *Drain) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	drain.mu.Lock()
+	if drain.draining {
+		drain.mu.Unlock()
+		message.RequeueWithoutBackoff(drain.RequeueDelay)
+		return ErrDraining
+	}
+	if drain.inFlight == 0 {
+		drain.idle = make(chan struct{})
+	}
+	drain.inFlight++
+	drain.mu.Unlock()
+
+	defer drain.done()
+	return next(ctx, message)
+}
+
+func (drain *Drain) done() {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+
+	drain.inFlight--
+	if drain.inFlight == 0 {
+		close(drain.idle)
+	}
+}
+
+// InFlight returns the number of messages currently in the rest of the chain.
+func (drain *Drain) InFlight() int64 {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+
+	return drain.inFlight
+}
+
+// Shutdown begins the shutdown: messages handled from now on are refused.
+func (drain *Drain) Shutdown() {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+
+	drain.draining = true
+}
+
+// Draining reports whether Shutdown has been called.
+func (drain *Drain) Draining() bool {
+	drain.mu.Lock()
+	defer drain.mu.Unlock()
+
+	return drain.draining
+}
+
+// Wait returns nil once no message is in flight, or ctx.Err() if ctx is done first.
+// It should be called after Shutdown, otherwise new messages may keep it waiting.
+func (drain *Drain) Wait(ctx context.Context) error {
+	drain.mu.Lock()
+	idle := drain.idle
+	inFlight := drain.inFlight
+	drain.mu.Unlock()
+
+	if inFlight == 0 {
+		return nil
+	}
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShutdownOnSignal calls Shutdown when one of signals is received, e.g. os.Interrupt or syscall.SIGTERM.
+// The returned function stops listening to the signals.
+func (drain *Drain) ShutdownOnSignal(signals ...os.Signal) (stop func()) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-ch:
+			drain.Shutdown()
+		case <-stopped:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(stopped)
+		})
+	}
+}
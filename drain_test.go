@@ -0,0 +1,78 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestDrainMiddleware(t *testing.T) {
+	drain := NewDrain()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(drain)
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	if err := drain.Wait(context.Background()); err != nil {
+		t.Errorf("Drain.Wait() error = %v", err)
+	}
+
+	go nsqMid.HandleMessage(&nsq.Message{})
+	<-started
+
+	if drain.InFlight() != 1 {
+		t.Errorf("Drain.InFlight() = %d, want 1", drain.InFlight())
+	}
+
+	drain.Shutdown()
+
+	message, delegate := newMockMessage(`{"message": 1}`)
+	if err := nsqMid.HandleMessage(message); err != ErrDraining {
+		t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, ErrDraining)
+	}
+	if delegate.requeued != 1 || delegate.backoff {
+		t.Errorf("message must be requeued without backoff. got: %+v", delegate)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := drain.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain.Wait() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(release)
+	if err := drain.Wait(context.Background()); err != nil {
+		t.Errorf("Drain.Wait() error = %v", err)
+	}
+	if drain.InFlight() != 0 {
+		t.Errorf("Drain.InFlight() = %d, want 0", drain.InFlight())
+	}
+}
+
+func TestDrain_ShutdownOnSignal(t *testing.T) {
+	drain := NewDrain()
+	stop := drain.ShutdownOnSignal(os.Interrupt)
+	defer stop()
+
+	process, _ := os.FindProcess(os.Getpid())
+	if err := process.Signal(os.Interrupt); err != nil {
+		t.Skipf("cannot signal the test process: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !drain.Draining() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !drain.Draining() {
+		t.Errorf("signal must begin the shutdown")
+	}
+}
@@ -0,0 +1,234 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// EnvelopeVersion is the version of the envelope formats written by this package.
+const EnvelopeVersion = 1
+
+// EnvelopeFormat is the encoding of an Envelope.
+type EnvelopeFormat uint32
+
+// These are the different envelope formats.
+const (
+	// EnvelopeBinary starts with envelopeMagic and the version, followed by the uvarint-prefixed
+	// headers and the body.
+	EnvelopeBinary EnvelopeFormat = iota
+	// EnvelopeJSON is a JSON object with nsqm_envelope, headers and body fields, readable by any consumer.
+	EnvelopeJSON
+)
+
+var (
+	envelopeMagic      = []byte{0x00, 'N', 'E', 'V'}
+	envelopeJSONPrefix = []byte(`{"nsqm_envelope":`)
+
+	errEnvelopeTruncated = errors.New("nsqm: truncated envelope")
+)
+
+// Envelope carries headers along with the body of a message, since NSQ messages have none.
+type Envelope struct {
+	Headers map[string]string
+	Body    []byte
+}
+
+type jsonEnvelope struct {
+	Version int               `json:"nsqm_envelope"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    []byte            `json:"body"`
+}
+
+// Marshal encodes the envelope with format.
+func (envelope *Envelope) Marshal(format EnvelopeFormat) ([]byte, error) {
+	if format == EnvelopeJSON {
+		return json.Marshal(jsonEnvelope{Version: EnvelopeVersion, Headers: envelope.Headers, Body: envelope.Body})
+	}
+
+	buff := bytes.NewBuffer(append(append([]byte(nil), envelopeMagic...), EnvelopeVersion))
+	writeUvarint(buff, uint64(len(envelope.Headers)))
+	for key, value := range envelope.Headers {
+		writeUvarint(buff, uint64(len(key)))
+		buff.WriteString(key)
+		writeUvarint(buff, uint64(len(value)))
+		buff.WriteString(value)
+	}
+	buff.Write(envelope.Body)
+	return buff.Bytes(), nil
+}
+
+func writeUvarint(buff *bytes.Buffer, v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buff.Write(scratch[:binary.PutUvarint(scratch[:], v)])
+}
+
+// ParseEnvelope decodes an envelope written in any format. It returns false for legacy bodies
+// that are not enveloped.
+func ParseEnvelope(data []byte) (*Envelope, bool, error) {
+	switch {
+	case bytes.HasPrefix(data, envelopeMagic):
+		envelope, err := parseBinaryEnvelope(data[len(envelopeMagic):])
+		return envelope, true, err
+	case bytes.HasPrefix(data, envelopeJSONPrefix):
+		var decoded jsonEnvelope
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			return nil, true, err
+		}
+		if decoded.Version != EnvelopeVersion {
+			return nil, true, fmt.Errorf("nsqm: unsupported envelope version %d", decoded.Version)
+		}
+		return &Envelope{Headers: decoded.Headers, Body: decoded.Body}, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// addEnvelopeHeaders returns body enveloped with format, carrying headers. A body that is already enveloped
+// keeps its format and gets headers added, its own headers taking precedence unless override is set.
+// This way middleware writing headers can run in any order without enveloping bodies twice.
+func addEnvelopeHeaders(body []byte, format EnvelopeFormat, headers map[string]string, override bool) ([]byte, error) {
+	envelope, ok, err := ParseEnvelope(body)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return (&Envelope{Headers: headers, Body: body}).Marshal(format)
+	}
+
+	format = EnvelopeJSON
+	if bytes.HasPrefix(body, envelopeMagic) {
+		format = EnvelopeBinary
+	}
+
+	merged := make(map[string]string, len(envelope.Headers)+len(headers))
+	for key, value := range headers {
+		merged[key] = value
+	}
+	for key, value := range envelope.Headers {
+		if _, set := headers[key]; !set || !override {
+			merged[key] = value
+		}
+	}
+
+	envelope.Headers = merged
+	return envelope.Marshal(format)
+}
+
+func parseBinaryEnvelope(data []byte) (*Envelope, error) {
+	if len(data) == 0 {
+		return nil, errEnvelopeTruncated
+	}
+	if data[0] != EnvelopeVersion {
+		return nil, fmt.Errorf("nsqm: unsupported envelope version %d", data[0])
+	}
+	data = data[1:]
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 || count > uint64(len(data)) {
+		return nil, errEnvelopeTruncated
+	}
+	data = data[n:]
+
+	headers := make(map[string]string, count)
+	for i := uint64(0); i < count; i++ {
+		var key, value string
+		var err error
+		if key, data, err = readString(data); err != nil {
+			return nil, err
+		}
+		if value, data, err = readString(data); err != nil {
+			return nil, err
+		}
+		headers[key] = value
+	}
+
+	return &Envelope{Headers: headers, Body: data}, nil
+}
+
+func readString(data []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return "", nil, errEnvelopeTruncated
+	}
+	data = data[n:]
+	return string(data[:length]), data[length:], nil
+}
+
+type headersKey struct{}
+
+// ContextWithHeaders returns a copy of ctx carrying headers.
+// WrapEnvelope publishes them along with the body.
+func ContextWithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
+// HeadersFromContext returns the headers carried by ctx, e.g. the headers of the message unwrapped by UnwrapEnvelope.
+func HeadersFromContext(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headersKey{}).(map[string]string)
+	return headers
+}
+
+// UnwrapEnvelope is a context-aware middleware handler that unwraps enveloped message bodies.
+// The headers are exposed to the next handlers with HeadersFromContext and the body is replaced
+// by the enveloped one. Legacy bodies pass through untouched, with no headers.
+// Malformed envelopes fail with a permanent error.
+type UnwrapEnvelope struct{}
+
+// NewUnwrapEnvelope returns a new UnwrapEnvelope instance.
+func NewUnwrapEnvelope() *UnwrapEnvelope {
+	return &UnwrapEnvelope{}
+}
+
+func (unwrap *UnwrapEnvelope) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	envelope, ok, err := ParseEnvelope(message.Body)
+	if err != nil {
+		return Permanent(err)
+	}
+
+	if ok {
+		ctx = ContextWithHeaders(ctx, envelope.Headers)
+		message.Body = envelope.Body
+	}
+	return next(ctx, message)
+}
+
+// WrapEnvelope is a publish middleware handler that wraps every body in an Envelope with Format.
+// The headers are Headers merged with the headers of the publish context, which take precedence.
+// Bodies already enveloped by other publish middleware, e.g. Tracing, get the headers they lack added instead.
+type WrapEnvelope struct {
+	Format  EnvelopeFormat
+	Headers map[string]string
+}
+
+// NewWrapEnvelope returns a new WrapEnvelope instance writing format with no static headers.
+func NewWrapEnvelope(format EnvelopeFormat) *WrapEnvelope {
+	return &WrapEnvelope{Format: format}
+}
+
+func (wrap *WrapEnvelope) HandlePublish(ctx context.Context, publishing *Publishing, next PublishFunc) error {
+	headers := make(map[string]string, len(wrap.Headers))
+	for key, value := range wrap.Headers {
+		headers[key] = value
+	}
+	for key, value := range HeadersFromContext(ctx) {
+		headers[key] = value
+	}
+
+	bodies := make([][]byte, len(publishing.Bodies))
+	for i, body := range publishing.Bodies {
+		wrapped, err := addEnvelopeHeaders(body, wrap.Format, headers, false)
+		if err != nil {
+			return err
+		}
+		bodies[i] = wrapped
+	}
+
+	publishing.Bodies = bodies
+	return next(ctx, publishing)
+}
@@ -0,0 +1,80 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestEnvelope(t *testing.T) {
+	for _, format := range []EnvelopeFormat{EnvelopeBinary, EnvelopeJSON} {
+		publisher := NewMemoryPublisher()
+		wrap := NewWrapEnvelope(format)
+		wrap.Headers = map[string]string{"content-type": "application/json", "tenant": "default"}
+
+		ctx := ContextWithHeaders(context.Background(), map[string]string{"tenant": "acme", "correlation-id": "42"})
+		if err := NewProducerChain(publisher, wrap).PublishContext(ctx, defaultTopic, []byte(`{"message": 1}`)); err != nil {
+			t.Fatalf("ProducerChain.PublishContext() error = %v", err)
+		}
+
+		var headers map[string]string
+		var body []byte
+
+		nsqMid := New(defaultTopic, defaultChannel)
+		nsqMid.UseContext(NewUnwrapEnvelope())
+		nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+			headers, body = HeadersFromContext(ctx), message.Body
+			return next(ctx, message)
+		})
+
+		message, _ := newMockMessage(string(publisher.Messages()[0].Body))
+		if err := nsqMid.HandleMessage(message); err != nil {
+			t.Errorf("NSQM.HandleMessage() error = %v", err)
+		}
+
+		want := map[string]string{"content-type": "application/json", "tenant": "acme", "correlation-id": "42"}
+		if !reflect.DeepEqual(headers, want) {
+			t.Errorf("format %d: headers = %v, want %v", format, headers, want)
+		}
+		if string(body) != `{"message": 1}` {
+			t.Errorf("format %d: body = %s", format, body)
+		}
+	}
+}
+
+func TestUnwrapEnvelope_Legacy(t *testing.T) {
+	var headers map[string]string
+	var body []byte
+
+	message, _ := newMockMessage(`{"message": 1}`)
+	err := NewUnwrapEnvelope().HandleMessageContext(context.Background(), defaultTopic, defaultChannel, message, func(ctx context.Context, message *nsq.Message) error {
+		headers, body = HeadersFromContext(ctx), message.Body
+		return nil
+	})
+
+	if err != nil || headers != nil || string(body) != `{"message": 1}` {
+		t.Errorf("legacy bodies must pass through. error = %v, headers = %v, body = %s", err, headers, body)
+	}
+}
+
+func TestParseEnvelope_Malformed(t *testing.T) {
+	wrapped, _ := (&Envelope{Headers: map[string]string{"key": "value"}, Body: []byte("body")}).Marshal(EnvelopeBinary)
+
+	tests := map[string][]byte{
+		"truncated": wrapped[:8],
+		"version":   append(append([]byte(nil), envelopeMagic...), 9),
+		"json":      []byte(`{"nsqm_envelope": 2, "body": ""}`),
+	}
+	for name, data := range tests {
+		if _, ok, err := ParseEnvelope(data); !ok || err == nil {
+			t.Errorf("%s: ParseEnvelope() ok = %v, error = %v, want error", name, ok, err)
+		}
+	}
+
+	message, _ := newMockMessage(string(tests["truncated"]))
+	if err := NewUnwrapEnvelope().HandleMessageContext(context.Background(), defaultTopic, defaultChannel, message, nil); !IsPermanent(err) {
+		t.Errorf("UnwrapEnvelope.HandleMessageContext() error = %v, want permanent error", err)
+	}
+}
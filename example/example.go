@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -11,7 +12,7 @@ import (
 
 	nsqm "github.com/ariefrahmansyah/nsq-middleware"
 	"github.com/nsqio/go-nsq"
-	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var nsqd = "127.0.0.1:4150"
@@ -52,34 +53,38 @@ func main() {
 		return nil
 	}
 
+	manager := nsqm.NewManager(nsqd)
+	health := nsqm.NewHealth()
+
 	for i := 1; i <= 3; i++ {
 		channelName := fmt.Sprintf("%s_%d", channel, i)
 
 		nsqMid := nsqm.New(topic, channelName)
 		nsqMid.Use(nsqm.NewRecovery())
+		nsqMid.UseContext(health)
 		nsqMid.Use(nsqm.NewLogger())
 		nsqMid.Use(nsqm.NewPrometheus())
 		nsqMid.Use(Middleware1{})
 		nsqMid.UseHandler(handler1)
 		nsqMid.UseHandlerFunc(handlerFunc1)
 
-		consumer, err := nsq.NewConsumer(topic, channelName, nsq.NewConfig())
-		if err != nil {
-			log.Fatalln(err)
-		}
-
-		consumer.AddHandler(nsqMid)
+		manager.Register(topic, channelName, nsqMid, nsq.NewConfig())
+	}
 
-		consumer.ConnectToNSQD(nsqd)
+	if err := manager.Start(context.Background()); err != nil {
+		log.Fatalln(err)
 	}
+	defer manager.Stop(context.Background())
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	http.Handle("/metrics", prometheus.Handler())
+	http.Handle("/metrics", promhttp.Handler())
 
+	http.Handle("/live", health.Liveness())
+	http.Handle("/ready", health.Readiness())
 	http.HandleFunc("/ping", ping)
 	http.ListenAndServe(":"+port, nil)
 }
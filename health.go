@@ -0,0 +1,284 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// HealthCheck is the state of a topic/channel reported by Health.
+type HealthCheck struct {
+	Topic       string    `json:"topic"`
+	Channel     string    `json:"channel"`
+	Live        bool      `json:"live"`
+	Ready       bool      `json:"ready"`
+	Reasons     []string  `json:"reasons,omitempty"`
+	Messages    int       `json:"messages"`
+	ErrorRate   float64   `json:"error_rate"`
+	LastSuccess time.Time `json:"last_success"`
+	// InFlight is the number of messages being handled.
+	InFlight int `json:"in_flight"`
+	// Circuit is the state of the watched CircuitBreaker, if any.
+	Circuit string `json:"circuit,omitempty"`
+	// Stats are the stats of the watched consumer, if any.
+	Stats *nsq.ConsumerStats `json:"stats,omitempty"`
+}
+
+// HealthReport is the JSON body served by the Health handlers.
+type HealthReport struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+type healthState struct {
+	topic       string
+	channel     string
+	since       time.Time
+	windowStart time.Time
+	messages    int
+	failures    int
+	lastSuccess time.Time
+	consumer    *nsq.Consumer
+	breaker     *CircuitBreaker
+	// failing is the number of failures since the last success, regardless of Window.
+	failing int
+	// inFlight holds the start time of the messages being handled.
+	inFlight map[uint64]time.Time
+	nextID   uint64
+}
+
+// Health is a context-aware middleware handler that records the results of messages per topic/channel,
+// and serves them as liveness and readiness probes, e.g. for Kubernetes.
+//
+// A topic/channel is not ready when its error rate over Window reaches MaxErrorRate, when its watched
+// CircuitBreaker is open, or when its watched consumer has no connection. It is not live when a message
+// has been handled for StaleAfter, which means the handler is stuck, or when every message failed since
+// the last success and that success is older than StaleAfter.
+//
+// Health is itself the readiness http.Handler. Probes respond 200 when every topic/channel passes,
+// and 503 otherwise.
+type Health struct {
+	Window time.Duration
+	// MaxErrorRate is the error rate from which a topic/channel is not ready. Zero disables the check.
+	MaxErrorRate float64
+	// MinMessages is the number of messages needed in Window before MaxErrorRate applies.
+	MinMessages int
+	// StaleAfter is how long a message can be handled, and how long a failing topic/channel can go without success,
+	// before it is not live. Zero disables the check.
+	StaleAfter time.Duration
+
+	mu     sync.Mutex
+	states map[string]*healthState
+}
+
+// NewHealth returns a new Health instance that is not ready from a 50% error rate over a minute,
+// and not live after 5 minutes of failures only.
+func NewHealth() *Health {
+	return &Health{
+		Window:       time.Minute,
+		MaxErrorRate: 0.5,
+		MinMessages:  10,
+		StaleAfter:   5 * time.Minute,
+		states:       map[string]*healthState{},
+	}
+}
+
+func (health *Health) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	id := health.start(topic, channel)
+
+	// A panic counts as a failure.
+	failure := true
+	defer func() {
+		health.done(topic, channel, id, failure)
+	}()
+
+	err := next(ctx, message)
+	failure = err != nil
+	return err
+}
+
+// start records a message being handled and returns its id in the in-flight messages.
+func (health *Health) start(topic, channel string) uint64 {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	state := health.state(topic, channel)
+	state.nextID++
+	state.inFlight[state.nextID] = time.Now()
+	return state.nextID
+}
+
+// done records the result of the message started with id.
+func (health *Health) done(topic, channel string, id uint64, failure bool) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	state := health.state(topic, channel)
+	delete(state.inFlight, id)
+
+	now := time.Now()
+	if now.Sub(state.windowStart) >= health.Window {
+		state.windowStart, state.messages, state.failures = now, 0, 0
+	}
+
+	state.messages++
+	if failure {
+		state.failures++
+		state.failing++
+	} else {
+		state.lastSuccess = now
+		state.failing = 0
+	}
+}
+
+// Register adds topic/channel to the reports before its first message.
+func (health *Health) Register(topic, channel string) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	health.state(topic, channel)
+}
+
+// WatchConsumer reports the stats of consumer for topic/channel. A consumer with no connection is not ready.
+func (health *Health) WatchConsumer(topic, channel string, consumer *nsq.Consumer) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	health.state(topic, channel).consumer = consumer
+}
+
+// WatchCircuitBreaker reports the state of breaker for topic/channel. An open breaker is not ready.
+func (health *Health) WatchCircuitBreaker(topic, channel string, breaker *CircuitBreaker) {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	health.state(topic, channel).breaker = breaker
+}
+
+// state must be called with the lock held.
+func (health *Health) state(topic, channel string) *healthState {
+	key := topic + "/" + channel
+	state, ok := health.states[key]
+	if !ok {
+		now := time.Now()
+		state = &healthState{topic: topic, channel: channel, since: now, windowStart: now, inFlight: map[uint64]time.Time{}}
+		health.states[key] = state
+	}
+	return state
+}
+
+// Checks returns the state of every topic/channel, sorted by topic and channel.
+func (health *Health) Checks() []HealthCheck {
+	health.mu.Lock()
+	defer health.mu.Unlock()
+
+	now := time.Now()
+	checks := make([]HealthCheck, 0, len(health.states))
+	for _, state := range health.states {
+		checks = append(checks, health.check(state, now))
+	}
+
+	sort.Slice(checks, func(i, j int) bool {
+		if checks[i].Topic != checks[j].Topic {
+			return checks[i].Topic < checks[j].Topic
+		}
+		return checks[i].Channel < checks[j].Channel
+	})
+	return checks
+}
+
+func (health *Health) check(state *healthState, now time.Time) HealthCheck {
+	check := HealthCheck{
+		Topic:       state.topic,
+		Channel:     state.channel,
+		Live:        true,
+		Ready:       true,
+		Messages:    state.messages,
+		LastSuccess: state.lastSuccess,
+		InFlight:    len(state.inFlight),
+	}
+	if state.messages > 0 {
+		check.ErrorRate = float64(state.failures) / float64(state.messages)
+	}
+
+	if health.MaxErrorRate > 0 && state.messages >= health.MinMessages && check.ErrorRate >= health.MaxErrorRate {
+		check.Ready = false
+		check.Reasons = append(check.Reasons, "error rate too high")
+	}
+
+	if state.breaker != nil {
+		circuit := state.breaker.State()
+		check.Circuit = circuit.String()
+		if circuit == CircuitOpen {
+			check.Ready = false
+			check.Reasons = append(check.Reasons, "circuit breaker open")
+		}
+	}
+
+	if state.consumer != nil {
+		check.Stats = state.consumer.Stats()
+		if check.Stats.Connections == 0 {
+			check.Ready = false
+			check.Reasons = append(check.Reasons, "consumer not connected")
+		}
+	}
+
+	lastSuccess := state.lastSuccess
+	if lastSuccess.IsZero() {
+		lastSuccess = state.since
+	}
+	if health.StaleAfter > 0 && state.failing > 0 && now.Sub(lastSuccess) >= health.StaleAfter {
+		check.Live = false
+		check.Reasons = append(check.Reasons, "no success since "+lastSuccess.Format(time.RFC3339))
+	}
+
+	var oldest time.Time
+	for _, start := range state.inFlight {
+		if oldest.IsZero() || start.Before(oldest) {
+			oldest = start
+		}
+	}
+	if health.StaleAfter > 0 && !oldest.IsZero() && now.Sub(oldest) >= health.StaleAfter {
+		check.Live = false
+		check.Reasons = append(check.Reasons, "message handled since "+oldest.Format(time.RFC3339))
+	}
+
+	return check
+}
+
+// ServeHTTP serves the readiness probe.
+func (health *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	health.serve(w, func(check HealthCheck) bool { return check.Live && check.Ready })
+}
+
+// Liveness returns the http.Handler serving the liveness probe.
+func (health *Health) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		health.serve(w, func(check HealthCheck) bool { return check.Live })
+	})
+}
+
+// Readiness returns the http.Handler serving the readiness probe.
+func (health *Health) Readiness() http.Handler {
+	return health
+}
+
+func (health *Health) serve(w http.ResponseWriter, pass func(check HealthCheck) bool) {
+	report := HealthReport{Status: "ok", Checks: health.Checks()}
+	status := http.StatusOK
+	for _, check := range report.Checks {
+		if !pass(check) {
+			report.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
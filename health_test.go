@@ -0,0 +1,124 @@
+package nsqmiddleware
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func probe(t *testing.T, handler http.Handler) (int, HealthReport) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/ready", nil))
+
+	var report HealthReport
+	if err := json.Unmarshal(recorder.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid report %s: %v", recorder.Body, err)
+	}
+	return recorder.Code, report
+}
+
+func TestHealthMiddleware(t *testing.T) {
+	health := NewHealth()
+	health.MinMessages = 2
+
+	failing := &mockMiddleware{}
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(health)
+	nsqMid.UseFunc(func(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+		return failing.HandleMessage(topic, channel, message, next)
+	})
+	health.Register(defaultTopic, "idle")
+
+	nsqMid.HandleMessage(&nsq.Message{})
+	if code, report := probe(t, health); code != http.StatusOK || report.Status != "ok" || len(report.Checks) != 2 {
+		t.Errorf("probe = %d %+v, want ok", code, report)
+	}
+
+	failing.err = errors.New("error")
+	for i := 0; i < 3; i++ {
+		nsqMid.HandleMessage(&nsq.Message{})
+	}
+
+	code, report := probe(t, health.Readiness())
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("readiness code = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	check := report.Checks[0]
+	if check.Ready || check.ErrorRate != 0.75 || check.Messages != 4 {
+		t.Errorf("check = %+v", check)
+	}
+
+	if code, _ := probe(t, health.Liveness()); code != http.StatusOK {
+		t.Errorf("liveness code = %d, want %d", code, http.StatusOK)
+	}
+
+	health.StaleAfter = time.Nanosecond
+	if code, _ := probe(t, health.Liveness()); code != http.StatusServiceUnavailable {
+		t.Errorf("liveness code = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHealth_Stuck(t *testing.T) {
+	health := NewHealth()
+	health.StaleAfter = 10 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(health)
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	go func() {
+		nsqMid.HandleMessage(&nsq.Message{})
+		close(done)
+	}()
+	<-started
+
+	// The stuck handler records neither success nor failure.
+	time.Sleep(20 * time.Millisecond)
+	code, report := probe(t, health.Liveness())
+	if code != http.StatusServiceUnavailable || report.Checks[0].InFlight != 1 {
+		t.Errorf("liveness = %d %+v, want %d with 1 message in flight", code, report, http.StatusServiceUnavailable)
+	}
+
+	close(release)
+	<-done
+	if code, report := probe(t, health.Liveness()); code != http.StatusOK {
+		t.Errorf("liveness = %d %+v, want %d", code, report, http.StatusOK)
+	}
+}
+
+func TestHealth_Watch(t *testing.T) {
+	health := NewHealth()
+
+	breaker := NewCircuitBreaker("downstream", 1, time.Minute)
+	breaker.record(0, true)
+	health.WatchCircuitBreaker(defaultTopic, defaultChannel, breaker)
+
+	consumer, err := nsq.NewConsumer(defaultTopic, defaultChannel, nsq.NewConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	health.WatchConsumer(defaultTopic, defaultChannel, consumer)
+
+	code, report := probe(t, health)
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("probe code = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	check := report.Checks[0]
+	if check.Circuit != "open" || check.Stats == nil || len(check.Reasons) != 2 {
+		t.Errorf("check = %+v", check)
+	}
+}
@@ -52,6 +52,7 @@ type Logger struct {
 	dateFormat string
 	template   *template.Template
 	level      Level
+	sink       StructuredSink
 }
 
 // NewLogger returns a new Logger instance.
@@ -77,6 +78,12 @@ func (logger *Logger) SetDateFormat(format string) {
 	logger.dateFormat = format
 }
 
+// SetStructuredSink switches the logger to structured mode. Entries are sent to sink as fields
+// instead of being rendered with the format. Passing nil switches back to the format.
+func (logger *Logger) SetStructuredSink(sink StructuredSink) {
+	logger.sink = sink
+}
+
 func (logger *Logger) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
 	start := time.Now()
 	status := "ok"
@@ -91,7 +98,24 @@ func (logger *Logger) HandleMessage(topic, channel string, message *nsq.Message,
 		errStr = err.Error()
 	}
 
-	if validToLog {
+	if validToLog && logger.sink != nil {
+		level := SuccessLevel
+		fields := []Field{
+			{"time", start.Format(logger.dateFormat)},
+			{"topic", topic},
+			{"channel", channel},
+			{"message_id", string(message.ID[:])},
+			{"attempts", message.Attempts},
+			{"duration", time.Since(start)},
+			{"status", status},
+		}
+		if err != nil {
+			level = ErrorLevel
+			fields = append(fields, Field{"error", errStr})
+		}
+
+		logger.sink.Log(level, fields)
+	} else if validToLog {
 		log := LoggerEntry{
 			StartTime:   start.Format(logger.dateFormat),
 			Status:      status,
@@ -104,7 +128,7 @@ func (logger *Logger) HandleMessage(topic, channel string, message *nsq.Message,
 
 		buff := &bytes.Buffer{}
 		logger.template.Execute(buff, log)
-		logger.Printf(buff.String())
+		logger.Printf("%s", buff.String())
 	}
 
 	return err
@@ -2,6 +2,7 @@ package nsqmiddleware
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"strings"
 	"testing"
@@ -89,3 +90,38 @@ func TestLogger_SetFormat(t *testing.T) {
 		t.Errorf("log body must not empty 😱")
 	}
 }
+
+func TestLogger_SetStructuredSink(t *testing.T) {
+	var buff bytes.Buffer
+
+	logger := NewLogger()
+	logger.SetStructuredSink(NewJSONSink(&buff))
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.Use(logger)
+	nsqMid.Use(mockMiddleware{err: errors.New("100% failed")})
+	nsqMid.HandleMessage(&nsq.Message{ID: nsq.MessageID{'i', 'd'}, Attempts: 1, Body: []byte(`{"message": 1}`)})
+
+	for _, want := range []string{`"topic":"topic_test"`, `"channel":"channel_test"`, `"attempts":1`, `"status":"error"`, `"error":"100% failed"`} {
+		if !strings.Contains(buff.String(), want) {
+			t.Errorf("log does not contain %s. got: %s", want, buff.String())
+		}
+	}
+}
+
+func TestLoggerMiddlewarePercentError(t *testing.T) {
+	var buff bytes.Buffer
+
+	logger := NewLogger()
+	logger.SetFormat("{{.ErrorString}}")
+	logger.ILogger = log.New(&buff, "", 0)
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.Use(logger)
+	nsqMid.Use(mockMiddleware{err: errors.New("100% failed")})
+	nsqMid.HandleMessage(&nsq.Message{Attempts: 1, Body: []byte(`{"message": 1}`)})
+
+	if strings.TrimSpace(buff.String()) != "100% failed" {
+		t.Errorf("expected log output is wrong. got: %s", buff.String())
+	}
+}
@@ -0,0 +1,195 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// ErrNoAddresses is returned by Manager.Start when neither nsqd nor nsqlookupd addresses are set.
+var ErrNoAddresses = errors.New("nsqm: no nsqd or nsqlookupd addresses")
+
+// ManagerDefaultDrainTimeout is the drain timeout used by the default Manager instance.
+var ManagerDefaultDrainTimeout = 30 * time.Second
+
+type registration struct {
+	topic       string
+	channel     string
+	nsqm        *NSQM
+	config      *nsq.Config
+	concurrency int
+}
+
+// Manager creates, connects and stops a nsq.Consumer per registered NSQM.
+// Consumers connect to the nsqlookupd addresses if any are set, otherwise to the nsqd addresses.
+type Manager struct {
+	NSQDAddresses    []string
+	LookupdAddresses []string
+	// DrainTimeout bounds the drain started when the context passed to Start is done.
+	DrainTimeout time.Duration
+
+	mu            sync.Mutex
+	registrations []registration
+	consumers     []*nsq.Consumer
+	stopped       chan struct{}
+}
+
+// NewManager returns a new Manager instance connecting to the nsqd addresses, with no registered NSQM.
+func NewManager(nsqdAddresses ...string) *Manager {
+	return &Manager{
+		NSQDAddresses: nsqdAddresses,
+		DrainTimeout:  ManagerDefaultDrainTimeout,
+	}
+}
+
+// Register adds a consumer of topic and channel handling messages with nsqm.
+// A nil config means nsq.NewConfig().
+func (manager *Manager) Register(topic, channel string, nsqm *NSQM, config *nsq.Config) {
+	manager.RegisterConcurrent(topic, channel, nsqm, config, 1)
+}
+
+// RegisterConcurrent adds a consumer of topic and channel handling up to concurrency messages at once with nsqm.
+// MaxInFlight should be raised in config accordingly.
+func (manager *Manager) RegisterConcurrent(topic, channel string, nsqm *NSQM, config *nsq.Config, concurrency int) {
+	if nsqm == nil {
+		panic("nsqm cannot be nil")
+	}
+	if config == nil {
+		config = nsq.NewConfig()
+	}
+
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	manager.registrations = append(manager.registrations, registration{topic, channel, nsqm, config, concurrency})
+}
+
+// Start creates and connects the consumers of every registered NSQM. If one fails, the consumers
+// created so far are stopped and the error is returned, and Start can be called again.
+// When ctx is done, the consumers are stopped and drained for up to DrainTimeout.
+func (manager *Manager) Start(ctx context.Context) error {
+	if len(manager.NSQDAddresses) == 0 && len(manager.LookupdAddresses) == 0 {
+		return ErrNoAddresses
+	}
+
+	manager.mu.Lock()
+	if manager.stopped != nil {
+		manager.mu.Unlock()
+		return errors.New("nsqm: manager already started")
+	}
+	manager.stopped = make(chan struct{})
+	registrations := manager.registrations
+	manager.mu.Unlock()
+
+	for _, reg := range registrations {
+		consumer, err := manager.connect(reg)
+		if err != nil {
+			manager.abort()
+			return fmt.Errorf("nsqm: cannot start consumer of %s/%s: %w", reg.topic, reg.channel, err)
+		}
+
+		manager.mu.Lock()
+		manager.consumers = append(manager.consumers, consumer)
+		manager.mu.Unlock()
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			drainCtx, cancel := context.WithTimeout(context.Background(), manager.DrainTimeout)
+			defer cancel()
+			manager.Stop(drainCtx)
+		case <-manager.stopped:
+		}
+	}()
+
+	return nil
+}
+
+// abort stops the consumers created by a failed Start, leaving the NSQM untouched, so Start can be called again.
+func (manager *Manager) abort() {
+	manager.mu.Lock()
+	consumers := manager.consumers
+	manager.consumers = nil
+	manager.stopped = nil
+	manager.mu.Unlock()
+
+	for _, consumer := range consumers {
+		consumer.Stop()
+	}
+}
+
+func (manager *Manager) connect(reg registration) (*nsq.Consumer, error) {
+	consumer, err := nsq.NewConsumer(reg.topic, reg.channel, reg.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if reg.concurrency > 1 {
+		consumer.AddConcurrentHandlers(reg.nsqm, reg.concurrency)
+	} else {
+		consumer.AddHandler(reg.nsqm)
+	}
+
+	if len(manager.LookupdAddresses) > 0 {
+		err = consumer.ConnectToNSQLookupds(manager.LookupdAddresses)
+	} else {
+		err = consumer.ConnectToNSQDs(manager.NSQDAddresses)
+	}
+	if err != nil {
+		consumer.Stop()
+		return nil, err
+	}
+	return consumer, nil
+}
+
+// Stop stops every consumer from receiving messages and waits for the in-flight messages to be handled,
+// i.e. for the StopChan of every consumer to be closed, or for ctx to be done, returning ctx.Err().
+// Then every registered NSQM is stopped with NSQM.Stop, canceling the contexts of the messages still
+// being handled for good, so a stopped Manager cannot be started again.
+func (manager *Manager) Stop(ctx context.Context) error {
+	manager.mu.Lock()
+	consumers := manager.consumers
+	registrations := manager.registrations
+	if manager.stopped != nil {
+		select {
+		case <-manager.stopped:
+		default:
+			close(manager.stopped)
+		}
+	}
+	manager.mu.Unlock()
+
+	for _, consumer := range consumers {
+		consumer.Stop()
+	}
+
+	var err error
+	for _, consumer := range consumers {
+		select {
+		case <-consumer.StopChan:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for _, reg := range registrations {
+		reg.nsqm.Stop()
+	}
+	return err
+}
+
+// Consumers returns the consumers created by Start, e.g. to read their Stats.
+func (manager *Manager) Consumers() []*nsq.Consumer {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	return append([]*nsq.Consumer(nil), manager.consumers...)
+}
@@ -0,0 +1,118 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestManager(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"channels": [], "producers": []}`))
+	}))
+	defer lookupd.Close()
+
+	canceled := make(chan struct{})
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		<-ctx.Done()
+		close(canceled)
+		return nil
+	})
+
+	manager := NewManager()
+	manager.LookupdAddresses = []string{strings.TrimPrefix(lookupd.URL, "http://")}
+	manager.Register(defaultTopic, defaultChannel, nsqMid, nil)
+	manager.RegisterConcurrent(defaultTopic, "channel_concurrent", New(defaultTopic, "channel_concurrent"), nil, 4)
+
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("Manager.Start() error = %v", err)
+	}
+	if len(manager.Consumers()) != 2 {
+		t.Errorf("Manager.Consumers() = %d consumers, want 2", len(manager.Consumers()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := manager.Stop(ctx); err != nil {
+		t.Errorf("Manager.Stop() error = %v", err)
+	}
+
+	for _, consumer := range manager.Consumers() {
+		select {
+		case <-consumer.StopChan:
+		default:
+			t.Errorf("consumer must be stopped")
+		}
+	}
+
+	// Messages handled after the drain see a canceled context.
+	go nsqMid.HandleMessage(&nsq.Message{})
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Errorf("NSQM must be stopped")
+	}
+}
+
+func TestManager_StartError(t *testing.T) {
+	manager := NewManager()
+	manager.Register(defaultTopic, defaultChannel, New(defaultTopic, defaultChannel), nil)
+	if err := manager.Start(context.Background()); err != ErrNoAddresses {
+		t.Errorf("Manager.Start() error = %v, want %v", err, ErrNoAddresses)
+	}
+
+	// Nothing listens on port 1.
+	manager = NewManager("127.0.0.1:1")
+	manager.Register(defaultTopic, defaultChannel, New(defaultTopic, defaultChannel), nil)
+	if err := manager.Start(context.Background()); err == nil {
+		t.Errorf("Manager.Start() error must not nil")
+	}
+	if len(manager.Consumers()) != 0 {
+		t.Errorf("failed consumers must not be kept")
+	}
+}
+
+func TestManager_StartAgain(t *testing.T) {
+	lookupd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"channels": [], "producers": []}`))
+	}))
+	defer lookupd.Close()
+
+	var handleErr error
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		handleErr = ctx.Err()
+		return nil
+	})
+
+	manager := NewManager()
+	manager.Register(defaultTopic, defaultChannel, nsqMid, nil)
+	manager.Register(defaultTopic, "channel_other", New(defaultTopic, "channel_other"), nil)
+
+	// The port is missing.
+	manager.LookupdAddresses = []string{"localhost"}
+	if err := manager.Start(context.Background()); err == nil {
+		t.Fatalf("Manager.Start() error must not nil")
+	}
+
+	manager.LookupdAddresses = []string{strings.TrimPrefix(lookupd.URL, "http://")}
+	if err := manager.Start(context.Background()); err != nil {
+		t.Fatalf("Manager.Start() error = %v", err)
+	}
+	defer manager.Stop(context.Background())
+
+	if len(manager.Consumers()) != 2 {
+		t.Errorf("Manager.Consumers() = %d consumers, want 2", len(manager.Consumers()))
+	}
+
+	nsqMid.HandleMessage(&nsq.Message{})
+	if handleErr != nil {
+		t.Errorf("a failed start must not stop the NSQM. context error = %v", handleErr)
+	}
+}
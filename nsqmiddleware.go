@@ -1,6 +1,10 @@
 package nsqmiddleware
 
-import "github.com/nsqio/go-nsq"
+import (
+	"context"
+
+	"github.com/nsqio/go-nsq"
+)
 
 // Handler is an interface that objects can implement to be registered to serve as middleware
 // in the NSQM middleware stack.
@@ -31,6 +35,69 @@ func (handlerFunc HandlerFunc) HandleMessage(topic, channel string, message *nsq
 	return handlerFunc(topic, channel, message, next)
 }
 
+// NextFunc is the context-aware counterpart of nsq.HandlerFunc. It is passed to ContextHandler
+// middleware to yield to the next middleware in the chain.
+type NextFunc func(ctx context.Context, message *nsq.Message) error
+
+// ContextHandler is an interface that objects can implement to be registered to serve as
+// context-aware middleware in the NSQM middleware stack.
+// HandleMessageContext should yield to the next middleware in the chain by invoking the next NextFunc
+// passed in, optionally with a derived context.
+//
+// The context is canceled once the message has been handled or the NSQM is stopped.
+type ContextHandler interface {
+	HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error
+}
+
+// ContextHandlerFunc is an adapter to allow the use of ordinary functions as context-aware NSQM handlers.
+// A ContextHandlerFunc is both a ContextHandler and a Handler, so it can be used with NSQM.Use directly.
+type ContextHandlerFunc func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error
+
+func (handlerFunc ContextHandlerFunc) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	return handlerFunc(ctx, topic, channel, message, next)
+}
+
+// HandleMessage calls the function with a background context, so it can be used as a plain Handler.
+func (handlerFunc ContextHandlerFunc) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+	return handlerFunc(context.Background(), topic, channel, message, func(ctx context.Context, message *nsq.Message) error {
+		return next(message)
+	})
+}
+
+// WrapContextHandler converts a ContextHandler into a nsqm.Handler so it can be used with NSQM.Use.
+// When invoked from a NSQM chain, the handler still receives the per-message context.
+func WrapContextHandler(handler ContextHandler) Handler {
+	if h, ok := handler.(Handler); ok {
+		return h
+	}
+	return ContextHandlerFunc(handler.HandleMessageContext)
+}
+
+// WrapHandlerContextFunc converts a context-aware message handler function into a nsqm.Handler, so the
+// last handler of a stack sees the deadline and cancellation of the message context.
+// The next NextFunc is automatically called after the function is executed.
+func WrapHandlerContextFunc(handlerFunc func(ctx context.Context, message *nsq.Message) error) Handler {
+	return ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		if err := handlerFunc(ctx, message); err != nil {
+			return err
+		}
+		return next(ctx, message)
+	})
+}
+
+// contextHandler returns the ContextHandler view of a Handler. Plain handlers are adapted so the
+// context is carried over to the next middleware in the chain.
+func contextHandler(handler Handler) ContextHandler {
+	if h, ok := handler.(ContextHandler); ok {
+		return h
+	}
+	return ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		return handler.HandleMessage(topic, channel, message, func(message *nsq.Message) error {
+			return next(ctx, message)
+		})
+	})
+}
+
 type middleware struct {
 	topic   string
 	channel string
@@ -39,7 +106,11 @@ type middleware struct {
 }
 
 func (m middleware) HandleMessage(message *nsq.Message) error {
-	return m.handler.HandleMessage(m.topic, m.channel, message, m.next.HandleMessage)
+	return m.HandleMessageContext(context.Background(), message)
+}
+
+func (m middleware) HandleMessageContext(ctx context.Context, message *nsq.Message) error {
+	return contextHandler(m.handler).HandleMessageContext(ctx, m.topic, m.channel, message, m.next.HandleMessageContext)
 }
 
 func buildMiddleware(topic, channel string, handlers []Handler) middleware {
@@ -67,21 +138,32 @@ func emptyMiddleware() middleware {
 
 // NSQM is a stack of Middleware Handlers that can be invoked as an nsq.Handler.
 // NSQM middleware is evaluated in the order that they are added to the stack using
-// the Use, UseHandler and UseHandlerFunc methods.
+// the Use, UseFunc, UseContext, UseHandler and UseHandlerFunc methods.
 type NSQM struct {
 	topic      string
 	channel    string
 	handlers   []Handler
 	middleware middleware
+	ctx        context.Context
+	cancel     context.CancelFunc
 }
 
 // New returns a new NSQM instance with no middleware preconfigured.
 func New(topic, channel string, handlers ...Handler) *NSQM {
+	return NewContext(context.Background(), topic, channel, handlers...)
+}
+
+// NewContext returns a new NSQM instance whose per-message contexts are derived from ctx.
+// Canceling ctx, or calling Stop, cancels the context of every message being handled.
+func NewContext(ctx context.Context, topic, channel string, handlers ...Handler) *NSQM {
+	ctx, cancel := context.WithCancel(ctx)
 	return &NSQM{
 		topic:      topic,
 		channel:    channel,
 		handlers:   handlers,
 		middleware: buildMiddleware(topic, channel, handlers),
+		ctx:        ctx,
+		cancel:     cancel,
 	}
 }
 
@@ -91,7 +173,27 @@ func NewDefault(topic, channel string) *NSQM {
 }
 
 func (nsqm NSQM) HandleMessage(message *nsq.Message) error {
-	return nsqm.middleware.HandleMessage(message)
+	ctx := nsqm.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return nsqm.HandleMessageContext(ctx, message)
+}
+
+// HandleMessageContext runs the middleware stack for message with a context derived from ctx.
+// The context is canceled when the stack returns.
+func (nsqm NSQM) HandleMessageContext(ctx context.Context, message *nsq.Message) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	return nsqm.middleware.HandleMessageContext(ctx, message)
+}
+
+// Stop cancels the context of every message currently being handled by the NSQM.
+// It should be called when the consumer using the NSQM is stopped.
+func (nsqm *NSQM) Stop() {
+	if nsqm.cancel != nil {
+		nsqm.cancel()
+	}
 }
 
 // Use adds a Handler onto the middleware stack. Handlers are invoked in the order they are added to a NSQM.
@@ -109,6 +211,20 @@ func (nsqm *NSQM) UseFunc(handlerFunc func(topic, channel string, message *nsq.M
 	nsqm.Use(HandlerFunc(handlerFunc))
 }
 
+// UseContext adds a ContextHandler onto the middleware stack.
+func (nsqm *NSQM) UseContext(handler ContextHandler) {
+	if handler == nil {
+		panic("handler cannot be nil")
+	}
+
+	nsqm.Use(WrapContextHandler(handler))
+}
+
+// UseContextFunc adds a context-aware handler function onto the middleware stack.
+func (nsqm *NSQM) UseContextFunc(handlerFunc func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error) {
+	nsqm.Use(ContextHandlerFunc(handlerFunc))
+}
+
 // UseHandler adds a nsq.Handler onto the middleware stack. Handlers are invoked in the order they are added to a NSQM.
 func (nsqm *NSQM) UseHandler(handler nsq.Handler) {
 	nsqm.Use(WrapHandler(handler))
@@ -118,3 +234,8 @@ func (nsqm *NSQM) UseHandler(handler nsq.Handler) {
 func (nsqm *NSQM) UseHandlerFunc(handlerFunc func(message *nsq.Message) error) {
 	nsqm.UseHandler(nsq.HandlerFunc(handlerFunc))
 }
+
+// UseHandlerContextFunc adds a context-aware message handler function onto the middleware stack.
+func (nsqm *NSQM) UseHandlerContextFunc(handlerFunc func(ctx context.Context, message *nsq.Message) error) {
+	nsqm.Use(WrapHandlerContextFunc(handlerFunc))
+}
@@ -1,12 +1,14 @@
 package nsqmiddleware
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/nsqio/go-nsq"
 )
@@ -59,6 +61,31 @@ func (m mockMiddleware) HandleMessage(topic, channel string, message *nsq.Messag
 	return next(message)
 }
 
+// mockDelegate records the responses sent for a message.
+type mockDelegate struct {
+	finished     int
+	requeued     int
+	touched      int
+	requeueDelay time.Duration
+	backoff      bool
+}
+
+func (d *mockDelegate) OnFinish(message *nsq.Message) { d.finished++ }
+func (d *mockDelegate) OnTouch(message *nsq.Message)  { d.touched++ }
+func (d *mockDelegate) OnRequeue(message *nsq.Message, delay time.Duration, backoff bool) {
+	d.requeued++
+	d.requeueDelay = delay
+	d.backoff = backoff
+}
+
+func newMockMessage(body string) (*nsq.Message, *mockDelegate) {
+	delegate := &mockDelegate{}
+	message := nsq.NewMessage(nsq.MessageID{'t', 'e', 's', 't'}, []byte(body))
+	message.Attempts = 1
+	message.Delegate = delegate
+	return message, delegate
+}
+
 var handlerFunc HandlerFunc
 
 var nsqHandlerFunc nsq.HandlerFunc
@@ -476,3 +503,52 @@ func TestNSQM_UseHandlerFunc(t *testing.T) {
 		})
 	}
 }
+
+type ctxKey struct{}
+
+func TestNSQM_UseContext(t *testing.T) {
+	var got interface{}
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		return next(context.WithValue(ctx, ctxKey{}, "value"), message)
+	})
+	nsqMid.Use(mockMiddleware{})
+	nsqMid.UseContext(ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		got = ctx.Value(ctxKey{})
+		return next(ctx, message)
+	}))
+
+	if err := nsqMid.HandleMessage(&nsq.Message{Body: []byte(`{"message": 1}`)}); err != nil {
+		t.Errorf("NSQM.HandleMessage() error = %v", err)
+	}
+
+	if got != "value" {
+		t.Errorf("context value = %v, want %v", got, "value")
+	}
+}
+
+func TestNSQM_Stop(t *testing.T) {
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		return ctx.Err()
+	})
+	nsqMid.Stop()
+
+	if err := nsqMid.HandleMessage(&nsq.Message{}); err != context.Canceled {
+		t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestWrapContextHandler(t *testing.T) {
+	got := WrapContextHandler(ContextHandlerFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		return next(ctx, message)
+	}))
+	if got == nil {
+		t.Errorf("WrapContextHandler() must not nil")
+	}
+
+	if err := got.HandleMessage(defaultTopic, defaultChannel, &nsq.Message{}, nsqHandlerFuncError); err == nil {
+		t.Errorf("Handler.HandleMessage() error must not nil")
+	}
+}
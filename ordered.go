@@ -0,0 +1,185 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrKeyQueueFull is returned by OrderedByKey when the queue of the key of a message is full.
+var ErrKeyQueueFull = errors.New("nsqm: key queue is full")
+
+// lane serializes the messages of a key. The head of the queue is the message running the rest of the chain.
+type lane struct {
+	queue []chan struct{}
+}
+
+// OrderedByKey is a context-aware middleware handler that runs messages sharing a key one at a time,
+// in the order they reach it, while messages of different keys run in parallel. It is meant to be used
+// with AddConcurrentHandlers. Messages waiting for their turn are touched every TouchInterval.
+//
+// When MaxQueue messages of a key are already waiting, the message is requeued without backoff
+// and ErrKeyQueueFull is returned, so it comes back later, out of order.
+//
+// OrderedByKey is a prometheus.Collector exposing the messages waiting and the queue depth they found.
+type OrderedByKey struct {
+	// Key extracts the key of a message, e.g. with JSONFieldKey.
+	Key KeyFunc
+	// MaxQueue is the number of messages of a key that can wait. Zero means unlimited.
+	MaxQueue int
+	// TouchInterval is how often waiting messages are touched. Zero disables touching.
+	TouchInterval time.Duration
+	// RequeueDelay is the delay of the messages refused because their queue is full.
+	RequeueDelay time.Duration
+
+	mu      sync.Mutex
+	lanes   map[string]*lane
+	metrics atomic.Pointer[orderedMetrics]
+}
+
+type orderedMetrics struct {
+	waiting *prometheus.GaugeVec
+	depth   *prometheus.HistogramVec
+}
+
+func newOrderedMetrics(config *prometheusConfig) *orderedMetrics {
+	return &orderedMetrics{
+		waiting: prometheus.NewGaugeVec(prometheus.GaugeOpts(config.opts("ordered", "waiting_messages",
+			"How many messages are waiting for the previous message of their key, partitioned by topic and channel.")),
+			[]string{"topic", "channel"},
+		),
+		depth: prometheus.NewHistogramVec(config.histogramOpts("ordered", "queue_depth",
+			"How many messages of the same key were ahead of a message when it arrived, partitioned by topic and channel.",
+			[]float64{0, 1, 2, 5, 10, 50, 100}),
+			[]string{"topic", "channel"},
+		),
+	}
+}
+
+// NewOrderedByKey returns a new OrderedByKey instance serializing messages by key, with up to 100 waiting messages per key.
+func NewOrderedByKey(key KeyFunc) *OrderedByKey {
+	return &OrderedByKey{
+		Key:           key,
+		MaxQueue:      100,
+		TouchInterval: 30 * time.Second,
+		RequeueDelay:  time.Second,
+	}
+}
+
+func (ordered *OrderedByKey) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	key := ordered.Key(topic, channel, message)
+	turn := make(chan struct{})
+
+	ordered.mu.Lock()
+	if ordered.lanes == nil {
+		ordered.lanes = map[string]*lane{}
+	}
+	l, ok := ordered.lanes[key]
+	if !ok {
+		l = &lane{}
+		ordered.lanes[key] = l
+	}
+
+	ahead := len(l.queue)
+	if ordered.MaxQueue > 0 && ahead > ordered.MaxQueue {
+		ordered.mu.Unlock()
+		message.RequeueWithoutBackoff(ordered.RequeueDelay)
+		return ErrKeyQueueFull
+	}
+
+	l.queue = append(l.queue, turn)
+	if ahead == 0 {
+		close(turn)
+	}
+	ordered.mu.Unlock()
+
+	loadMetrics(&ordered.metrics, newOrderedMetrics).depth.WithLabelValues(topic, channel).Observe(float64(ahead))
+
+	if ahead > 0 {
+		if err := ordered.wait(ctx, topic, channel, message, turn); err != nil {
+			ordered.leave(key, turn)
+			return err
+		}
+	}
+	defer ordered.leave(key, turn)
+
+	return next(ctx, message)
+}
+
+// wait blocks until it is the turn of the message, touching it meanwhile.
+func (ordered *OrderedByKey) wait(ctx context.Context, topic, channel string, message *nsq.Message, turn chan struct{}) error {
+	waiting := loadMetrics(&ordered.metrics, newOrderedMetrics).waiting.WithLabelValues(topic, channel)
+	waiting.Inc()
+	defer waiting.Dec()
+
+	var touch <-chan time.Time
+	if ordered.TouchInterval > 0 {
+		ticker := time.NewTicker(ordered.TouchInterval)
+		defer ticker.Stop()
+		touch = ticker.C
+	}
+
+	for {
+		select {
+		case <-turn:
+			return nil
+		case <-touch:
+			message.Touch()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// leave removes turn from the queue of key and, if it was the head, hands the turn over to the next message.
+func (ordered *OrderedByKey) leave(key string, turn chan struct{}) {
+	ordered.mu.Lock()
+	defer ordered.mu.Unlock()
+
+	l := ordered.lanes[key]
+	for i, queued := range l.queue {
+		if queued != turn {
+			continue
+		}
+
+		l.queue = append(l.queue[:i], l.queue[i+1:]...)
+		if i == 0 && len(l.queue) > 0 {
+			close(l.queue[0])
+		}
+		break
+	}
+
+	if len(l.queue) == 0 {
+		delete(ordered.lanes, key)
+	}
+}
+
+func (ordered *OrderedByKey) shareMetrics(config *prometheusConfig) error {
+	metrics := newOrderedMetrics(config)
+	if err := shareCollector(config.registerer, &metrics.waiting); err != nil {
+		return err
+	}
+	if err := shareCollector(config.registerer, &metrics.depth); err != nil {
+		return err
+	}
+
+	ordered.metrics.Store(metrics)
+	return nil
+}
+
+func (ordered *OrderedByKey) Describe(ch chan<- *prometheus.Desc) {
+	metrics := loadMetrics(&ordered.metrics, newOrderedMetrics)
+	metrics.waiting.Describe(ch)
+	metrics.depth.Describe(ch)
+}
+
+func (ordered *OrderedByKey) Collect(ch chan<- prometheus.Metric) {
+	metrics := loadMetrics(&ordered.metrics, newOrderedMetrics)
+	metrics.waiting.Collect(ch)
+	metrics.depth.Collect(ch)
+}
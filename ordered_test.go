@@ -0,0 +1,165 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestOrderedByKeyMiddleware(t *testing.T) {
+	var mu sync.Mutex
+	running := map[string]int{}
+	maxRunning := map[string]int{}
+	parallel := 0
+	maxParallel := 0
+	var got []string
+
+	ordered := NewOrderedByKey(JSONFieldKey("key"))
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(ordered)
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		key := JSONFieldKey("key")(defaultTopic, defaultChannel, message)
+
+		mu.Lock()
+		running[key]++
+		parallel++
+		if running[key] > maxRunning[key] {
+			maxRunning[key] = running[key]
+		}
+		if parallel > maxParallel {
+			maxParallel = parallel
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running[key]--
+		parallel--
+		got = append(got, string(message.Body))
+		mu.Unlock()
+		return nil
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b"} {
+			message, _ := newMockMessage(fmt.Sprintf(`{"key": %q, "seq": %d}`, key, i))
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				nsqMid.HandleMessage(message)
+			}()
+		}
+		// Let the message reach its queue before the next one of the same key.
+		time.Sleep(2 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if maxRunning["a"] != 1 || maxRunning["b"] != 1 {
+		t.Errorf("messages of a key must run serially. got: %v", maxRunning)
+	}
+	if maxParallel < 2 {
+		t.Errorf("messages of different keys must run in parallel")
+	}
+
+	var seqA []string
+	for _, body := range got {
+		if strings.Contains(body, `"a"`) {
+			seqA = append(seqA, body[strings.Index(body, "seq"):])
+		}
+	}
+	if strings.Join(seqA, ",") != `seq": 0},seq": 1},seq": 2}` {
+		t.Errorf("messages of a key must run in order. got: %v", seqA)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(ordered)
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if !strings.Contains(body, `nsqm_ordered_queue_depth_count{channel="channel_test",topic="topic_test"} 6`) {
+		t.Errorf("queue depth must be observed. got: %s", body)
+	}
+}
+
+func TestOrderedByKey_QueueFull(t *testing.T) {
+	ordered := NewOrderedByKey(TopicKey)
+	ordered.MaxQueue = 1
+	ordered.TouchInterval = 5 * time.Millisecond
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	next := func(ctx context.Context, message *nsq.Message) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+
+	go ordered.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, &nsq.Message{}, next)
+	<-started
+
+	waiting, waitingDelegate := newMockMessage(`{"message": 1}`)
+	done := make(chan error)
+	go func() {
+		done <- ordered.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, waiting, next)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	message, delegate := newMockMessage(`{"message": 1}`)
+	if err := ordered.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, message, next); err != ErrKeyQueueFull {
+		t.Errorf("OrderedByKey.HandleMessageContext() error = %v, want %v", err, ErrKeyQueueFull)
+	}
+	if delegate.requeued != 1 || delegate.backoff {
+		t.Errorf("message must be requeued without backoff. got: %+v", delegate)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("OrderedByKey.HandleMessageContext() error = %v", err)
+	}
+	if waitingDelegate.touched == 0 {
+		t.Errorf("waiting message must be touched")
+	}
+}
+
+func TestOrderedByKey_Canceled(t *testing.T) {
+	ordered := NewOrderedByKey(TopicKey)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go ordered.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, &nsq.Message{}, func(ctx context.Context, message *nsq.Message) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ordered.HandleMessageContext(ctx, defaultTopic, defaultChannel, &nsq.Message{}, nil); err != context.Canceled {
+		t.Errorf("OrderedByKey.HandleMessageContext() error = %v, want %v", err, context.Canceled)
+	}
+	close(release)
+
+	// The canceled message left the queue, so the next one runs once the first is done.
+	ran := make(chan struct{})
+	go ordered.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, &nsq.Message{}, func(ctx context.Context, message *nsq.Message) error {
+		close(ran)
+		return nil
+	})
+
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Errorf("next message must run")
+	}
+}
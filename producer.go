@@ -0,0 +1,248 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Producer is the publishing interface of *nsq.Producer.
+// It is implemented by *nsq.Producer, ProducerChain and MemoryPublisher.
+type Producer interface {
+	Publish(topic string, body []byte) error
+	MultiPublish(topic string, body [][]byte) error
+	DeferredPublish(topic string, delay time.Duration, body []byte) error
+	PublishAsync(topic string, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error
+	MultiPublishAsync(topic string, body [][]byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error
+	DeferredPublishAsync(topic string, delay time.Duration, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error
+}
+
+// PublishKind is the kind of publish command.
+type PublishKind uint32
+
+// These are the different publish kinds.
+const (
+	PublishSingle PublishKind = iota
+	PublishMulti
+	PublishDeferred
+)
+
+// Publishing describes a publish going through a ProducerChain.
+// Middleware may change any field, e.g. to rewrite the bodies, before yielding to the next PublishFunc.
+type Publishing struct {
+	Kind   PublishKind
+	Topic  string
+	Bodies [][]byte
+	Delay  time.Duration
+	// Async is set for the async variants, along with DoneChan and Args.
+	// DoneChan may be nil to publish without waiting for the result.
+	Async    bool
+	DoneChan chan *nsq.ProducerTransaction
+	Args     []interface{}
+}
+
+// PublishFunc yields to the next publish middleware in the chain.
+type PublishFunc func(ctx context.Context, publishing *Publishing) error
+
+// PublishHandler is an interface that objects can implement to be registered to serve as middleware
+// in the ProducerChain middleware stack.
+// HandlePublish should yield to the next middleware in the chain by invoking the next PublishFunc passed in.
+type PublishHandler interface {
+	HandlePublish(ctx context.Context, publishing *Publishing, next PublishFunc) error
+}
+
+// PublishHandlerFunc is an adapter to allow the use of ordinary functions as publish handlers.
+type PublishHandlerFunc func(ctx context.Context, publishing *Publishing, next PublishFunc) error
+
+func (handlerFunc PublishHandlerFunc) HandlePublish(ctx context.Context, publishing *Publishing, next PublishFunc) error {
+	return handlerFunc(ctx, publishing, next)
+}
+
+// ProducerChain is a stack of publish middleware in front of a Producer.
+// Middleware is evaluated in the order that they are added to the stack using the Use and UseFunc methods,
+// and the Producer is called last.
+type ProducerChain struct {
+	producer Producer
+	handlers []PublishHandler
+	publish  PublishFunc
+}
+
+// NewProducerChain returns a new ProducerChain publishing through producer.
+func NewProducerChain(producer Producer, handlers ...PublishHandler) *ProducerChain {
+	chain := &ProducerChain{
+		producer: producer,
+		handlers: handlers,
+	}
+	chain.build()
+	return chain
+}
+
+// Use adds a PublishHandler onto the middleware stack. Handlers are invoked in the order they are added.
+func (chain *ProducerChain) Use(handler PublishHandler) {
+	if handler == nil {
+		panic("handler cannot be nil")
+	}
+
+	chain.handlers = append(chain.handlers, handler)
+	chain.build()
+}
+
+// UseFunc adds a publish handler function onto the middleware stack.
+func (chain *ProducerChain) UseFunc(handlerFunc func(ctx context.Context, publishing *Publishing, next PublishFunc) error) {
+	chain.Use(PublishHandlerFunc(handlerFunc))
+}
+
+func (chain *ProducerChain) build() {
+	publish := chain.send
+	for i := len(chain.handlers) - 1; i >= 0; i-- {
+		handler, next := chain.handlers[i], publish
+		publish = func(ctx context.Context, publishing *Publishing) error {
+			return handler.HandlePublish(ctx, publishing, next)
+		}
+	}
+	chain.publish = publish
+}
+
+// send calls the Producer method matching publishing.
+func (chain *ProducerChain) send(ctx context.Context, publishing *Publishing) error {
+	async := publishing.Async
+
+	switch publishing.Kind {
+	case PublishMulti:
+		if async {
+			return chain.producer.MultiPublishAsync(publishing.Topic, publishing.Bodies, publishing.DoneChan, publishing.Args...)
+		}
+		return chain.producer.MultiPublish(publishing.Topic, publishing.Bodies)
+	case PublishDeferred:
+		if async {
+			return chain.producer.DeferredPublishAsync(publishing.Topic, publishing.Delay, publishing.body(), publishing.DoneChan, publishing.Args...)
+		}
+		return chain.producer.DeferredPublish(publishing.Topic, publishing.Delay, publishing.body())
+	default:
+		if async {
+			return chain.producer.PublishAsync(publishing.Topic, publishing.body(), publishing.DoneChan, publishing.Args...)
+		}
+		return chain.producer.Publish(publishing.Topic, publishing.body())
+	}
+}
+
+func (publishing *Publishing) body() []byte {
+	if len(publishing.Bodies) == 0 {
+		return nil
+	}
+	return publishing.Bodies[0]
+}
+
+// Do runs publishing through the middleware stack with ctx.
+func (chain *ProducerChain) Do(ctx context.Context, publishing *Publishing) error {
+	return chain.publish(ctx, publishing)
+}
+
+// PublishContext publishes body to topic with ctx.
+func (chain *ProducerChain) PublishContext(ctx context.Context, topic string, body []byte) error {
+	return chain.Do(ctx, &Publishing{Kind: PublishSingle, Topic: topic, Bodies: [][]byte{body}})
+}
+
+func (chain *ProducerChain) Publish(topic string, body []byte) error {
+	return chain.PublishContext(context.Background(), topic, body)
+}
+
+func (chain *ProducerChain) MultiPublish(topic string, body [][]byte) error {
+	return chain.Do(context.Background(), &Publishing{Kind: PublishMulti, Topic: topic, Bodies: body})
+}
+
+func (chain *ProducerChain) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return chain.Do(context.Background(), &Publishing{Kind: PublishDeferred, Topic: topic, Bodies: [][]byte{body}, Delay: delay})
+}
+
+func (chain *ProducerChain) PublishAsync(topic string, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error {
+	return chain.Do(context.Background(), &Publishing{Kind: PublishSingle, Topic: topic, Bodies: [][]byte{body}, Async: true, DoneChan: doneChan, Args: args})
+}
+
+func (chain *ProducerChain) MultiPublishAsync(topic string, body [][]byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error {
+	return chain.Do(context.Background(), &Publishing{Kind: PublishMulti, Topic: topic, Bodies: body, Async: true, DoneChan: doneChan, Args: args})
+}
+
+func (chain *ProducerChain) DeferredPublishAsync(topic string, delay time.Duration, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error {
+	return chain.Do(context.Background(), &Publishing{Kind: PublishDeferred, Topic: topic, Bodies: [][]byte{body}, Delay: delay, Async: true, DoneChan: doneChan, Args: args})
+}
+
+// PublishedMessage is a message recorded by MemoryPublisher.
+type PublishedMessage struct {
+	Topic string
+	Body  []byte
+	Delay time.Duration
+}
+
+// MemoryPublisher is an in-memory Producer that records every published message.
+// It is meant to be used in tests.
+type MemoryPublisher struct {
+	// Err, when set, is returned by Publish and nothing is recorded.
+	Err error
+
+	mu       sync.Mutex
+	messages []PublishedMessage
+}
+
+// NewMemoryPublisher returns a new, empty MemoryPublisher.
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (publisher *MemoryPublisher) Publish(topic string, body []byte) error {
+	return publisher.record(topic, 0, body)
+}
+
+func (publisher *MemoryPublisher) MultiPublish(topic string, body [][]byte) error {
+	return publisher.record(topic, 0, body...)
+}
+
+func (publisher *MemoryPublisher) DeferredPublish(topic string, delay time.Duration, body []byte) error {
+	return publisher.record(topic, delay, body)
+}
+
+func (publisher *MemoryPublisher) PublishAsync(topic string, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error {
+	return publisher.done(publisher.Publish(topic, body), doneChan, args)
+}
+
+func (publisher *MemoryPublisher) MultiPublishAsync(topic string, body [][]byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error {
+	return publisher.done(publisher.MultiPublish(topic, body), doneChan, args)
+}
+
+func (publisher *MemoryPublisher) DeferredPublishAsync(topic string, delay time.Duration, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error {
+	return publisher.done(publisher.DeferredPublish(topic, delay, body), doneChan, args)
+}
+
+func (publisher *MemoryPublisher) record(topic string, delay time.Duration, bodies ...[]byte) error {
+	if publisher.Err != nil {
+		return publisher.Err
+	}
+
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+
+	for _, body := range bodies {
+		publisher.messages = append(publisher.messages, PublishedMessage{Topic: topic, Body: body, Delay: delay})
+	}
+	return nil
+}
+
+// done reports the result of an async publish on doneChan, like *nsq.Producer does.
+func (publisher *MemoryPublisher) done(err error, doneChan chan *nsq.ProducerTransaction, args []interface{}) error {
+	if doneChan != nil {
+		go func() {
+			doneChan <- &nsq.ProducerTransaction{Error: err, Args: args}
+		}()
+	}
+	return nil
+}
+
+// Messages returns the messages published so far.
+func (publisher *MemoryPublisher) Messages() []PublishedMessage {
+	publisher.mu.Lock()
+	defer publisher.mu.Unlock()
+
+	return append([]PublishedMessage(nil), publisher.messages...)
+}
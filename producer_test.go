@@ -0,0 +1,121 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestProducerChain(t *testing.T) {
+	var order []string
+
+	publisher := NewMemoryPublisher()
+
+	chain := NewProducerChain(publisher, PublishHandlerFunc(func(ctx context.Context, publishing *Publishing, next PublishFunc) error {
+		order = append(order, "first")
+		return next(ctx, publishing)
+	}))
+	chain.UseFunc(func(ctx context.Context, publishing *Publishing, next PublishFunc) error {
+		order = append(order, "second")
+		for i, body := range publishing.Bodies {
+			publishing.Bodies[i] = bytes.ToUpper(body)
+		}
+		return next(ctx, publishing)
+	})
+
+	if err := chain.Publish("a", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.MultiPublish("b", [][]byte{[]byte("two"), []byte("three")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.DeferredPublish("c", time.Second, []byte("four")); err != nil {
+		t.Fatal(err)
+	}
+
+	doneChan := make(chan *nsq.ProducerTransaction, 1)
+	if err := chain.DeferredPublishAsync("d", time.Minute, []byte("five"), doneChan, "arg"); err != nil {
+		t.Fatal(err)
+	}
+
+	transaction := <-doneChan
+	if transaction.Error != nil || len(transaction.Args) != 1 || transaction.Args[0] != "arg" {
+		t.Errorf("unexpected transaction: %+v", transaction)
+	}
+
+	want := []PublishedMessage{
+		{"a", []byte("ONE"), 0},
+		{"b", []byte("TWO"), 0},
+		{"b", []byte("THREE"), 0},
+		{"c", []byte("FOUR"), time.Second},
+		{"d", []byte("FIVE"), time.Minute},
+	}
+
+	got := publisher.Messages()
+	if len(got) != len(want) {
+		t.Fatalf("messages = %d, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Topic != want[i].Topic || !bytes.Equal(got[i].Body, want[i].Body) || got[i].Delay != want[i].Delay {
+			t.Errorf("message %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if len(order) != 8 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("unexpected middleware order: %v", order)
+	}
+}
+
+func TestProducerChain_Error(t *testing.T) {
+	publisher := NewMemoryPublisher()
+	publisher.Err = errors.New("error")
+
+	chain := NewProducerChain(publisher)
+	if err := chain.Publish("a", []byte("one")); err != publisher.Err {
+		t.Errorf("ProducerChain.Publish() error = %v, want %v", err, publisher.Err)
+	}
+}
+
+func TestProducerChain_Use(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Use(nil) must panic")
+		}
+	}()
+
+	NewProducerChain(NewMemoryPublisher()).Use(nil)
+}
+
+// asyncProducer is a MemoryPublisher counting the async publishes.
+type asyncProducer struct {
+	*MemoryPublisher
+	async int
+}
+
+func (producer *asyncProducer) PublishAsync(topic string, body []byte, doneChan chan *nsq.ProducerTransaction, args ...interface{}) error {
+	producer.async++
+	return producer.MemoryPublisher.PublishAsync(topic, body, doneChan, args...)
+}
+
+func TestProducerChain_AsyncWithoutDoneChan(t *testing.T) {
+	producer := &asyncProducer{MemoryPublisher: NewMemoryPublisher()}
+
+	chain := NewProducerChain(producer)
+	if err := chain.PublishAsync("a", []byte("one"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.Publish("a", []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+
+	if producer.async != 1 {
+		t.Errorf("async publishes = %d, want 1", producer.async)
+	}
+	if got := producer.Messages(); len(got) != 2 {
+		t.Errorf("messages = %d, want 2", len(got))
+	}
+}
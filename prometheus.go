@@ -1,65 +1,305 @@
 package nsqmiddleware
 
 import (
-	"fmt"
+	"errors"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/nsqio/go-nsq"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// The names of the Prometheus metrics, prefixed with the namespace and subsystem.
 const (
-	promMessageName  = "nsqm_consumer_messages_total"
-	promDurationName = "nsqm_consumer_duration_milliseconds"
+	promMessageName  = "messages_total"
+	promDurationName = "duration_milliseconds"
+	promInFlightName = "in_flight_messages"
+	promAttemptsName = "attempts"
+	promAgeName      = "message_age_milliseconds"
 )
 
-var (
-	promMessage *prometheus.CounterVec
-	promLatency *prometheus.HistogramVec
-)
+// PrometheusDefaultBuckets is the millisecond bucket layout used by the default Prometheus instance.
+var PrometheusDefaultBuckets = []float64{300, 1000, 2500, 5000}
 
-func init() {
-	promMessage = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: promMessageName,
-			Help: "How many NSQ messages processed, partitioned by topic, channel, attempts and status.",
-		},
-		[]string{"topic", "channel", "attempts", "status"},
-	)
-	prometheus.MustRegister(promMessage)
-
-	buckets := []float64{300, 1000, 2500, 5000}
-	promLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    promDurationName,
-		Help:    "How long it took to consume the message, partitioned by topic, channel, attempts and status.",
-		Buckets: buckets,
-	},
-		[]string{"topic", "channel", "attempts", "status"},
-	)
-	prometheus.MustRegister(promLatency)
+// PrometheusDefaultAttemptsBuckets is the bucket layout of the attempts histogram.
+var PrometheusDefaultAttemptsBuckets = []float64{1, 2, 3, 5, 10, 25, 100}
+
+// PrometheusDefaultAgeBuckets is the millisecond bucket layout of the message age histogram.
+var PrometheusDefaultAgeBuckets = []float64{100, 1000, 10000, 60000, 300000, 3600000}
+
+// PrometheusOption configures a Prometheus instance.
+type PrometheusOption func(*prometheusConfig)
+
+type prometheusConfig struct {
+	registerer   prometheus.Registerer
+	namespace    string
+	subsystem    string
+	constLabels  prometheus.Labels
+	buckets      []float64
+	ageBuckets   []float64
+	bucketFactor float64
+	collectors   []prometheus.Collector
+}
+
+// WithRegisterer registers the metrics against registerer instead of prometheus.DefaultRegisterer.
+func WithRegisterer(registerer prometheus.Registerer) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.registerer = registerer
+	}
+}
+
+// WithNamespace sets the namespace of the metric names. Defaults to "nsqm".
+func WithNamespace(namespace string) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.namespace = namespace
+	}
+}
+
+// WithSubsystem sets the subsystem of the metric names. Defaults to "consumer" for the Prometheus metrics.
+// The metrics of the collectors given to WithCollectors are prefixed with it.
+func WithSubsystem(subsystem string) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.subsystem = subsystem
+	}
+}
+
+// WithConstLabels adds labels with fixed values to every metric.
+func WithConstLabels(labels prometheus.Labels) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.constLabels = labels
+	}
+}
+
+// WithBuckets sets the bucket layout, in milliseconds, of the duration histogram.
+func WithBuckets(buckets []float64) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.buckets = buckets
+	}
+}
+
+// WithAgeBuckets sets the bucket layout, in milliseconds, of the message age histogram.
+func WithAgeBuckets(buckets []float64) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.ageBuckets = buckets
+	}
+}
+
+// WithNativeHistogram turns the histograms into native histograms with the given bucket factor.
+// Classic buckets are still exposed alongside unless WithBuckets is given an empty layout.
+func WithNativeHistogram(bucketFactor float64) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.bucketFactor = bucketFactor
+	}
+}
+
+// WithCollectors registers the collectors of other middleware, e.g. ConcurrencyLimit,
+// against the same registerer as the Prometheus metrics. See RegisterCollectors.
+// NewPrometheus panics if one of them cannot be registered.
+func WithCollectors(collectors ...prometheus.Collector) PrometheusOption {
+	return func(config *prometheusConfig) {
+		config.collectors = append(config.collectors, collectors...)
+	}
+}
+
+// RegisterCollectors registers collectors against the registerer of options.
+//
+// The metrics of the middleware of this package, e.g. CircuitBreaker, are created again with the namespace,
+// subsystem and const labels of options, and shared by every instance registered with the same options,
+// so several instances of a middleware can be registered, e.g. breakers told apart by name.
+// What an instance recorded before being registered is not carried over.
+// Other collectors are registered as is.
+func RegisterCollectors(collectors []prometheus.Collector, options ...PrometheusOption) error {
+	return newPrometheusConfig(options...).register(collectors)
+}
+
+// sharedCollector is a middleware whose metrics are shared by the instances registered with the same config.
+type sharedCollector interface {
+	prometheus.Collector
+	shareMetrics(config *prometheusConfig) error
+}
+
+func newPrometheusConfig(options ...PrometheusOption) *prometheusConfig {
+	config := &prometheusConfig{
+		registerer: prometheus.DefaultRegisterer,
+		namespace:  "nsqm",
+		buckets:    PrometheusDefaultBuckets,
+		ageBuckets: PrometheusDefaultAgeBuckets,
+	}
+	for _, option := range options {
+		option(config)
+	}
+	return config
+}
+
+func (config *prometheusConfig) register(collectors []prometheus.Collector) error {
+	for _, collector := range collectors {
+		if shared, ok := collector.(sharedCollector); ok {
+			if err := shared.shareMetrics(config); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := config.registerer.Register(collector); err != nil {
+			var registered prometheus.AlreadyRegisteredError
+			if errors.As(err, &registered) && registered.ExistingCollector == collector {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// loadMetrics returns the metrics of a middleware, creating them with the default config
+// when the middleware was not built by its constructor, e.g. as a struct literal.
+func loadMetrics[M any](metrics *atomic.Pointer[M], newMetrics func(config *prometheusConfig) *M) *M {
+	if loaded := metrics.Load(); loaded != nil {
+		return loaded
+	}
+
+	metrics.CompareAndSwap(nil, newMetrics(newPrometheusConfig()))
+	return metrics.Load()
+}
+
+// opts returns the options of a middleware metric, named after the namespace, subsystem and const labels of config.
+func (config *prometheusConfig) opts(subsystem, name, help string) prometheus.Opts {
+	if config.subsystem != "" {
+		subsystem = strings.TrimSuffix(config.subsystem+"_"+subsystem, "_")
+	}
+
+	return prometheus.Opts{
+		Namespace:   config.namespace,
+		Subsystem:   subsystem,
+		Name:        name,
+		Help:        help,
+		ConstLabels: config.constLabels,
+	}
+}
+
+func (config *prometheusConfig) histogramOpts(subsystem, name, help string, buckets []float64) prometheus.HistogramOpts {
+	opts := config.opts(subsystem, name, help)
+	return prometheus.HistogramOpts{
+		Namespace:                   opts.Namespace,
+		Subsystem:                   opts.Subsystem,
+		Name:                        opts.Name,
+		Help:                        opts.Help,
+		ConstLabels:                 opts.ConstLabels,
+		Buckets:                     buckets,
+		NativeHistogramBucketFactor: config.bucketFactor,
+	}
 }
 
 // Prometheus is a handler that exposes prometheus metrics
-// for the number of messages, and the process duration,
-// partitioned by topic, channel, attempts and status.
-type Prometheus struct{}
+// for the number of messages, the process duration and the attempts, partitioned by topic, channel and status,
+// along with the number of in-flight messages and the message age, partitioned by topic and channel.
+type Prometheus struct {
+	messages *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	inFlight *prometheus.GaugeVec
+	attempts *prometheus.HistogramVec
+	age      *prometheus.HistogramVec
+}
 
 // NewPrometheus returns a new Prometheus Middleware instance.
-func NewPrometheus() *Prometheus {
-	return &Prometheus{}
+// Instances created with the same registerer, namespace and subsystem share their metrics.
+func NewPrometheus(options ...PrometheusOption) *Prometheus {
+	config := newPrometheusConfig(options...)
+	// The subsystem of config replaces the default one rather than prefixing it.
+	subsystem := ""
+	if config.subsystem == "" {
+		subsystem = "consumer"
+	}
+
+	messages := prometheus.NewCounterVec(prometheus.CounterOpts(config.opts(subsystem, promMessageName,
+		"How many NSQ messages processed, partitioned by topic, channel and status.")),
+		[]string{"topic", "channel", "status"},
+	)
+
+	latency := prometheus.NewHistogramVec(config.histogramOpts(subsystem, promDurationName,
+		"How long it took to consume the message, partitioned by topic, channel and status.", config.buckets),
+		[]string{"topic", "channel", "status"},
+	)
+
+	inFlight := prometheus.NewGaugeVec(prometheus.GaugeOpts(config.opts(subsystem, promInFlightName,
+		"How many NSQ messages are being processed, partitioned by topic and channel.")),
+		[]string{"topic", "channel"},
+	)
+
+	attemptsOpts := config.histogramOpts(subsystem, promAttemptsName,
+		"How many times the message has been attempted, partitioned by topic, channel and status.", PrometheusDefaultAttemptsBuckets)
+	// Attempts are small integers, the classic buckets are enough.
+	attemptsOpts.NativeHistogramBucketFactor = 0
+	attempts := prometheus.NewHistogramVec(attemptsOpts,
+		[]string{"topic", "channel", "status"},
+	)
+
+	age := prometheus.NewHistogramVec(config.histogramOpts(subsystem, promAgeName,
+		"How long ago the message was published when consumption started, partitioned by topic and channel.", config.ageBuckets),
+		[]string{"topic", "channel"},
+	)
+
+	if err := config.register(config.collectors); err != nil {
+		panic(err)
+	}
+
+	return &Prometheus{
+		messages: registerCollector(config.registerer, messages),
+		latency:  registerCollector(config.registerer, latency),
+		inFlight: registerCollector(config.registerer, inFlight),
+		attempts: registerCollector(config.registerer, attempts),
+		age:      registerCollector(config.registerer, age),
+	}
+}
+
+// registerCollector registers collector, returning the already registered collector if there is one.
+func registerCollector[C prometheus.Collector](registerer prometheus.Registerer, collector C) C {
+	if err := shareCollector(registerer, &collector); err != nil {
+		panic(err)
+	}
+	return collector
+}
+
+// shareCollector registers collector, replacing it with the already registered collector if there is one.
+func shareCollector[C prometheus.Collector](registerer prometheus.Registerer, collector *C) error {
+	if err := registerer.Register(*collector); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if errors.As(err, &registered) {
+			if existing, ok := registered.ExistingCollector.(C); ok {
+				*collector = existing
+				return nil
+			}
+		}
+		return err
+	}
+	return nil
 }
 
-func (prometheus Prometheus) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+func (prom *Prometheus) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
 	start := time.Now()
 	status := "ok"
 
+	if message.Timestamp > 0 {
+		prom.age.WithLabelValues(topic, channel).Observe(milliseconds(start.Sub(time.Unix(0, message.Timestamp))))
+	}
+
+	inFlight := prom.inFlight.WithLabelValues(topic, channel)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
 	err := next(message)
 	if err != nil {
 		status = "error"
 	}
 
-	go promMessage.WithLabelValues(topic, channel, fmt.Sprint(message.Attempts), status).Inc()
-	go promLatency.WithLabelValues(topic, channel, fmt.Sprint(message.Attempts), status).Observe(float64(time.Since(start).Nanoseconds()) / 1000000)
+	prom.messages.WithLabelValues(topic, channel, status).Inc()
+	prom.latency.WithLabelValues(topic, channel, status).Observe(milliseconds(time.Since(start)))
+	prom.attempts.WithLabelValues(topic, channel, status).Observe(float64(message.Attempts))
 
 	return err
 }
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration.Nanoseconds()) / 1000000
+}
@@ -5,20 +5,34 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/nsqio/go-nsq"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/urfave/negroni"
 )
 
-func TestPrometheusMiddleware(t *testing.T) {
+func scrape(t *testing.T, handler http.Handler) string {
 	recorder := httptest.NewRecorder()
 
 	n := negroni.New()
 	r := http.NewServeMux()
-	r.Handle("/metrics", prometheus.Handler())
+	r.Handle("/metrics", handler)
 	n.UseHandler(r)
 
+	reqMetrics, err := http.NewRequest("GET", "http://localhost:8080/metrics", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	n.ServeHTTP(recorder, reqMetrics)
+
+	return recorder.Body.String()
+}
+
+func TestPrometheusMiddleware(t *testing.T) {
 	// Success handler
 	nsqMid := New(defaultTopic, defaultChannel)
 	nsqMid.Use(NewPrometheus())
@@ -31,20 +45,171 @@ func TestPrometheusMiddleware(t *testing.T) {
 	nsqMid.UseHandlerFunc(nsqHandlerFuncError)
 	nsqMid.HandleMessage(&nsq.Message{Body: []byte(`{"message": 1}`)})
 
-	reqMetrics, err := http.NewRequest("GET", "http://localhost:8080/metrics", nil)
+	body := scrape(t, promhttp.Handler())
+
+	if !strings.Contains(body, "nsqm_consumer_"+promMessageName) && !strings.Contains(body, "ok") && !strings.Contains(body, "error") {
+		t.Errorf("body does not contain all expected consumed messages '%s' metrics!", promMessageName)
+	}
+
+	if !strings.Contains(body, "nsqm_consumer_"+promDurationName) {
+		t.Errorf("body does not contain consumer duration '%s'", promDurationName)
+	}
+}
+
+func TestNewPrometheus_Options(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	prom := NewPrometheus(
+		WithRegisterer(registry),
+		WithNamespace("app"),
+		WithSubsystem("worker"),
+		WithConstLabels(prometheus.Labels{"service": "test"}),
+		WithBuckets([]float64{10, 20}),
+	)
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.Use(prom)
+	nsqMid.Use(mockMiddleware{})
+	nsqMid.HandleMessage(&nsq.Message{Body: []byte(`{"message": 1}`)})
+
+	if again := NewPrometheus(WithRegisterer(registry), WithNamespace("app"), WithSubsystem("worker"), WithConstLabels(prometheus.Labels{"service": "test"}), WithBuckets([]float64{10, 20})); again.messages != prom.messages {
+		t.Errorf("NewPrometheus() must reuse registered metrics")
+	}
+
+	families, err := registry.Gather()
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	n.ServeHTTP(recorder, reqMetrics)
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+
+	for _, want := range []string{"app_worker_messages_total", "app_worker_duration_milliseconds"} {
+		if !names[want] {
+			t.Errorf("registry does not contain %s. got: %v", want, names)
+		}
+	}
 
-	body := recorder.Body.String()
+	if strings.Contains(scrape(t, promhttp.Handler()), "app_worker_messages_total") {
+		t.Errorf("default registry must not contain custom registerer metrics")
+	}
+}
 
-	if !strings.Contains(body, promMessageName) && !strings.Contains(body, "ok") && !strings.Contains(body, "error") {
-		t.Errorf("body does not contain all expected consumed messages '%s' metrics!", promMessageName)
+func TestPrometheus_InFlightAttemptsAge(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	prom := NewPrometheus(WithRegisterer(registry))
+
+	var inFlight float64
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.Use(prom)
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		inFlight = testutil.ToFloat64(prom.inFlight.WithLabelValues(defaultTopic, defaultChannel))
+		return nil
+	})
+
+	message := &nsq.Message{Attempts: 3, Timestamp: time.Now().Add(-2 * time.Second).UnixNano()}
+	nsqMid.HandleMessage(message)
+
+	if inFlight != 1 {
+		t.Errorf("in-flight while handling = %v, want 1", inFlight)
 	}
 
-	if !strings.Contains(body, promDurationName) {
-		t.Errorf("body does not contain consumer duration '%s'", promDurationName)
+	if got := testutil.ToFloat64(prom.inFlight.WithLabelValues(defaultTopic, defaultChannel)); got != 0 {
+		t.Errorf("in-flight after handling = %v, want 0", got)
+	}
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	for _, want := range []string{
+		"nsqm_consumer_" + promAttemptsName + `_sum{channel="channel_test",status="ok",topic="topic_test"} 3`,
+		"nsqm_consumer_" + promAgeName + `_bucket{channel="channel_test",topic="topic_test",le="1000"} 0`,
+		"nsqm_consumer_" + promAgeName + `_bucket{channel="channel_test",topic="topic_test",le="10000"} 1`,
+		"nsqm_consumer_" + promInFlightName,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %s", want)
+		}
+	}
+
+	if strings.Contains(body, `attempts="`) {
+		t.Errorf("body must not contain attempts label")
+	}
+}
+
+func TestRegisterCollectors(t *testing.T) {
+	registry := prometheus.NewRegistry()
+
+	breakerA := NewCircuitBreaker("a", 1, time.Minute)
+	breakerB := NewCircuitBreaker("b", 1, time.Minute)
+	NewPrometheus(
+		WithRegisterer(registry),
+		WithNamespace("app"),
+		WithConstLabels(prometheus.Labels{"service": "test"}),
+		WithCollectors(breakerA, breakerB),
+	)
+
+	breakerB.record(0, true)
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	for _, want := range []string{
+		`app_circuit_breaker_state{name="a",service="test"} 0`,
+		`app_circuit_breaker_state{name="b",service="test"} 1`,
+		`app_circuit_breaker_transitions_total{from="closed",name="b",service="test",to="open"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %s. got: %s", want, body)
+		}
+	}
+
+	// Other collectors are registered as is, and their errors are returned.
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "app_circuit_breaker_state", Help: "Conflicting."})
+	if err := RegisterCollectors([]prometheus.Collector{counter}, WithRegisterer(registry)); err == nil {
+		t.Errorf("RegisterCollectors() must return the registration error")
+	}
+}
+
+func TestRegisterCollectors_Literal(t *testing.T) {
+	limit := &ConcurrencyLimit{Limit: 1}
+	rateLimit := &RateLimit{NewLimiter: func() Limiter { return NewTokenBucket(1000, 1) }}
+	validate := &Validate{}
+	validate.RegisterStruct("other", struct{}{})
+	router := &Router{Classify: TopicKey}
+	router.Handle(defaultTopic, New(defaultTopic, defaultChannel))
+	ordered := &OrderedByKey{Key: TopicKey}
+	breaker := &CircuitBreaker{Name: "literal", ConsecutiveFailures: 1, OpenTimeout: time.Minute}
+
+	collectors := []prometheus.Collector{limit, rateLimit, validate, router, ordered, breaker}
+
+	// Middleware built as struct literals handle messages before and after being registered.
+	handle := func() {
+		nsqMid := New(defaultTopic, defaultChannel)
+		for _, collector := range collectors {
+			nsqMid.UseContext(collector.(ContextHandler))
+		}
+		nsqMid.UseHandlerFunc(nsqHandlerFuncError)
+		message, _ := newMockMessage(`{"message": 1}`)
+		nsqMid.HandleMessage(message)
+	}
+
+	handle()
+	registry := prometheus.NewRegistry()
+	if err := RegisterCollectors(collectors, WithRegisterer(registry)); err != nil {
+		t.Fatal(err)
+	}
+	handle()
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	for _, want := range []string{
+		`nsqm_concurrency_wait_milliseconds_count{channel="channel_test",topic="topic_test"} 1`,
+		`nsqm_ordered_queue_depth_count{channel="channel_test",topic="topic_test"} 1`,
+		`nsqm_router_messages_total{channel="channel_test",route="topic_test",topic="topic_test"} 1`,
+		`nsqm_circuit_breaker_state{name="literal"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body does not contain %s. got: %s", want, body)
+		}
 	}
 }
@@ -0,0 +1,386 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrRateLimited is returned by RateLimit when the rate is exhausted and the policy does not block.
+var ErrRateLimited = errors.New("nsqm: rate limit exceeded")
+
+// Limiter is a rate limiter. Implementations must be safe for concurrent use.
+type Limiter interface {
+	// Take consumes a token if one is available at now. Otherwise it returns how long until one is.
+	Take(now time.Time) (time.Duration, bool)
+	// Tokens returns the number of tokens available at now.
+	Tokens(now time.Time) float64
+}
+
+// TokenBucket is a Limiter that refills rate tokens per second, up to burst tokens.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a new, full TokenBucket.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (bucket *TokenBucket) Take(now time.Time) (time.Duration, bool) {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.refill(now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second)), false
+}
+
+func (bucket *TokenBucket) Tokens(now time.Time) float64 {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+
+	bucket.refill(now)
+	return bucket.tokens
+}
+
+func (bucket *TokenBucket) refill(now time.Time) {
+	if !bucket.last.IsZero() && now.After(bucket.last) {
+		bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	}
+	if now.After(bucket.last) {
+		bucket.last = now
+	}
+}
+
+// SlidingWindow is a Limiter that allows limit events per window.
+// It weights the count of the previous window by how much of it still overlaps the sliding window.
+type SlidingWindow struct {
+	mu       sync.Mutex
+	limit    float64
+	window   time.Duration
+	start    time.Time
+	current  float64
+	previous float64
+}
+
+// NewSlidingWindow returns a new SlidingWindow allowing limit events per window.
+func NewSlidingWindow(limit int, window time.Duration) *SlidingWindow {
+	return &SlidingWindow{limit: float64(limit), window: window}
+}
+
+func (sw *SlidingWindow) Take(now time.Time) (time.Duration, bool) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	elapsed := sw.advance(now)
+	if sw.count(elapsed)+1 <= sw.limit {
+		sw.current++
+		return 0, true
+	}
+
+	// Wait until enough of the previous window has slid out, or until the next window.
+	delay := sw.window - elapsed
+	if sw.previous > 0 && sw.current+1 <= sw.limit {
+		overlap := (sw.limit - sw.current - 1) / sw.previous
+		delay = time.Duration((1-overlap)*float64(sw.window)) - elapsed
+	}
+	if delay <= 0 {
+		delay = time.Millisecond
+	}
+	return delay, false
+}
+
+func (sw *SlidingWindow) Tokens(now time.Time) float64 {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	return math.Max(0, sw.limit-sw.count(sw.advance(now)))
+}
+
+// advance moves the windows forward to now and returns the time elapsed in the current window.
+func (sw *SlidingWindow) advance(now time.Time) time.Duration {
+	if sw.start.IsZero() {
+		sw.start = now
+	}
+
+	elapsed := now.Sub(sw.start)
+	if elapsed >= 2*sw.window {
+		sw.previous, sw.current = 0, 0
+		sw.start = now.Add(-elapsed % sw.window)
+	} else if elapsed >= sw.window {
+		sw.previous, sw.current = sw.current, 0
+		sw.start = sw.start.Add(sw.window)
+	}
+
+	if elapsed < 0 {
+		return 0
+	}
+	return now.Sub(sw.start)
+}
+
+func (sw *SlidingWindow) count(elapsed time.Duration) float64 {
+	return sw.previous*(1-float64(elapsed)/float64(sw.window)) + sw.current
+}
+
+// JSONFieldKey returns a KeyFunc that extracts a top-level field from a JSON body.
+// Bodies that are not JSON objects, or lack the field, get an empty key.
+func JSONFieldKey(field string) KeyFunc {
+	return func(topic, channel string, message *nsq.Message) string {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(message.Body, &fields); err != nil {
+			return ""
+		}
+
+		value, ok := fields[field]
+		if !ok || value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	}
+}
+
+// RateLimit is a context-aware middleware handler that caps the throughput of the rest of the chain.
+// Every key gets its own Limiter, created by NewLimiter. When the rate is exhausted, the message waits
+// for a token, is requeued with the computed delay, or fails, depending on Policy.
+// Every SweepInterval, the limiters no message is using and that are back to full are dropped,
+// so keys extracted from message bodies do not accumulate.
+//
+// RateLimit is a prometheus.Collector exposing the messages that found the rate exhausted, and the
+// tokens left: the lowest level among the limiters of a topic/channel.
+type RateLimit struct {
+	// NewLimiter creates the Limiter of a key. It is required.
+	NewLimiter func() Limiter
+	// Key partitions the rate. Defaults to TopicChannelKey.
+	Key KeyFunc
+	// Policy decides what happens when the rate is exhausted.
+	Policy SaturationPolicy
+	// SweepInterval is how often full limiters are dropped.
+	SweepInterval time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*keyLimiter
+	lastSweep time.Time
+	metrics   atomic.Pointer[rateLimitMetrics]
+}
+
+// keyLimiter is the Limiter of a key, along with the number of messages using it
+// and the topic/channel of the message it was created for.
+type keyLimiter struct {
+	Limiter
+	users          int
+	topic, channel string
+}
+
+type rateLimitMetrics struct {
+	limited *prometheus.CounterVec
+	tokens  *rateLimitTokens
+}
+
+// rateLimitTokens collects the tokens left in the limiters of every RateLimit registered with the same config.
+type rateLimitTokens struct {
+	desc *prometheus.Desc
+
+	mu         sync.Mutex
+	rateLimits []*RateLimit
+}
+
+// NewRateLimit returns a new RateLimit instance that waits for tokens of a token bucket per topic/channel.
+func NewRateLimit(rate float64, burst int) *RateLimit {
+	return &RateLimit{
+		NewLimiter:    func() Limiter { return NewTokenBucket(rate, burst) },
+		Key:           TopicChannelKey,
+		Policy:        SaturationBlock,
+		SweepInterval: time.Minute,
+	}
+}
+
+func newRateLimitMetrics(config *prometheusConfig) *rateLimitMetrics {
+	tokens := config.opts("rate_limit", "tokens",
+		"The fewest tokens left among the limiters in use, partitioned by topic and channel.")
+
+	return &rateLimitMetrics{
+		limited: prometheus.NewCounterVec(prometheus.CounterOpts(config.opts("", "rate_limited_messages_total",
+			"How many messages found the rate exhausted, partitioned by topic and channel.")),
+			[]string{"topic", "channel"},
+		),
+		tokens: &rateLimitTokens{
+			desc: prometheus.NewDesc(prometheus.BuildFQName(tokens.Namespace, tokens.Subsystem, tokens.Name),
+				tokens.Help, []string{"topic", "channel"}, tokens.ConstLabels),
+		},
+	}
+}
+
+func (rateLimit *RateLimit) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	key := TopicChannelKey(topic, channel, message)
+	if rateLimit.Key != nil {
+		key = rateLimit.Key(topic, channel, message)
+	}
+	limiter := rateLimit.limiter(key, topic, channel)
+	defer rateLimit.leave(limiter)
+
+	for i := 0; ; i++ {
+		delay, ok := limiter.Take(time.Now())
+		if ok {
+			break
+		}
+		if i == 0 {
+			loadMetrics(&rateLimit.metrics, newRateLimitMetrics).limited.WithLabelValues(topic, channel).Inc()
+		}
+
+		switch rateLimit.Policy {
+		case SaturationRequeue:
+			message.RequeueWithoutBackoff(delay)
+			return ErrRateLimited
+		case SaturationFail:
+			return ErrRateLimited
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	return next(ctx, message)
+}
+
+// limiter returns the limiter of key, creating it if needed. It must be given back with leave.
+func (rateLimit *RateLimit) limiter(key, topic, channel string) *keyLimiter {
+	rateLimit.mu.Lock()
+	defer rateLimit.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(rateLimit.lastSweep) >= rateLimit.SweepInterval {
+		rateLimit.sweep(now)
+	}
+
+	if rateLimit.limiters == nil {
+		rateLimit.limiters = map[string]*keyLimiter{}
+	}
+
+	limiter, ok := rateLimit.limiters[key]
+	if !ok {
+		limiter = &keyLimiter{Limiter: rateLimit.NewLimiter(), topic: topic, channel: channel}
+		rateLimit.limiters[key] = limiter
+	}
+	limiter.users++
+	return limiter
+}
+
+func (rateLimit *RateLimit) leave(limiter *keyLimiter) {
+	rateLimit.mu.Lock()
+	defer rateLimit.mu.Unlock()
+
+	limiter.users--
+}
+
+// sweep drops the unused limiters that are as full as a new one, since dropping them loses no state.
+// It must be called with the lock held.
+func (rateLimit *RateLimit) sweep(now time.Time) {
+	rateLimit.lastSweep = now
+	if len(rateLimit.limiters) == 0 {
+		return
+	}
+
+	full := rateLimit.NewLimiter().Tokens(now)
+	for key, limiter := range rateLimit.limiters {
+		if limiter.users == 0 && limiter.Tokens(now) >= full {
+			delete(rateLimit.limiters, key)
+		}
+	}
+}
+
+func (rateLimit *RateLimit) shareMetrics(config *prometheusConfig) error {
+	metrics := newRateLimitMetrics(config)
+	if err := shareCollector(config.registerer, &metrics.limited); err != nil {
+		return err
+	}
+	if err := shareCollector(config.registerer, &metrics.tokens); err != nil {
+		return err
+	}
+
+	metrics.tokens.add(rateLimit)
+	rateLimit.metrics.Store(metrics)
+	return nil
+}
+
+// collectTokens adds the lowest tokens left per topic/channel among the limiters of rateLimit to levels.
+func (rateLimit *RateLimit) collectTokens(now time.Time, levels map[[2]string]float64) {
+	rateLimit.mu.Lock()
+	defer rateLimit.mu.Unlock()
+
+	for _, limiter := range rateLimit.limiters {
+		labels := [2]string{limiter.topic, limiter.channel}
+		tokens := limiter.Tokens(now)
+		if level, ok := levels[labels]; !ok || tokens < level {
+			levels[labels] = tokens
+		}
+	}
+}
+
+func (rateLimit *RateLimit) Describe(ch chan<- *prometheus.Desc) {
+	metrics := loadMetrics(&rateLimit.metrics, newRateLimitMetrics)
+	metrics.limited.Describe(ch)
+	metrics.tokens.Describe(ch)
+}
+
+func (rateLimit *RateLimit) Collect(ch chan<- prometheus.Metric) {
+	metrics := loadMetrics(&rateLimit.metrics, newRateLimitMetrics)
+	metrics.limited.Collect(ch)
+	metrics.tokens.collect(ch, rateLimit)
+}
+
+func (tokens *rateLimitTokens) add(rateLimit *RateLimit) {
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	for _, added := range tokens.rateLimits {
+		if added == rateLimit {
+			return
+		}
+	}
+	tokens.rateLimits = append(tokens.rateLimits, rateLimit)
+}
+
+func (tokens *rateLimitTokens) collect(ch chan<- prometheus.Metric, rateLimits ...*RateLimit) {
+	now := time.Now()
+	levels := map[[2]string]float64{}
+	for _, rateLimit := range rateLimits {
+		rateLimit.collectTokens(now, levels)
+	}
+
+	for labels, level := range levels {
+		ch <- prometheus.MustNewConstMetric(tokens.desc, prometheus.GaugeValue, level, labels[0], labels[1])
+	}
+}
+
+func (tokens *rateLimitTokens) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tokens.desc
+}
+
+func (tokens *rateLimitTokens) Collect(ch chan<- prometheus.Metric) {
+	tokens.mu.Lock()
+	rateLimits := append([]*RateLimit(nil), tokens.rateLimits...)
+	tokens.mu.Unlock()
+
+	tokens.collect(ch, rateLimits...)
+}
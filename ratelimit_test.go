@@ -0,0 +1,214 @@
+package nsqmiddleware
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := NewTokenBucket(2, 2)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := bucket.Take(now); !ok {
+			t.Fatalf("Take() %d must succeed", i)
+		}
+	}
+
+	delay, ok := bucket.Take(now)
+	if ok || delay != 500*time.Millisecond {
+		t.Errorf("Take() = %v, %v, want %v, false", delay, ok, 500*time.Millisecond)
+	}
+
+	if tokens := bucket.Tokens(now.Add(250 * time.Millisecond)); tokens != 0.5 {
+		t.Errorf("Tokens() = %v, want 0.5", tokens)
+	}
+
+	if _, ok := bucket.Take(now.Add(500 * time.Millisecond)); !ok {
+		t.Errorf("Take() must succeed after refill")
+	}
+
+	if tokens := bucket.Tokens(now.Add(time.Hour)); tokens != 2 {
+		t.Errorf("Tokens() = %v, want burst 2", tokens)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	now := time.Now()
+	window := NewSlidingWindow(2, time.Second)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := window.Take(now); !ok {
+			t.Fatalf("Take() %d must succeed", i)
+		}
+	}
+
+	delay, ok := window.Take(now.Add(200 * time.Millisecond))
+	if ok || delay != 800*time.Millisecond {
+		t.Errorf("Take() = %v, %v, want %v, false", delay, ok, 800*time.Millisecond)
+	}
+
+	// Half of the previous window still overlaps: 2*0.5 = 1 event counted.
+	if tokens := window.Tokens(now.Add(1500 * time.Millisecond)); tokens != 1 {
+		t.Errorf("Tokens() = %v, want 1", tokens)
+	}
+
+	if _, ok := window.Take(now.Add(1500 * time.Millisecond)); !ok {
+		t.Fatalf("Take() must succeed in the next window")
+	}
+
+	delay, ok = window.Take(now.Add(1500 * time.Millisecond))
+	if ok || delay <= 0 {
+		t.Errorf("Take() = %v, %v, want positive delay, false", delay, ok)
+	}
+
+	if tokens := window.Tokens(now.Add(10 * time.Second)); tokens != 2 {
+		t.Errorf("Tokens() = %v, want 2", tokens)
+	}
+}
+
+func TestJSONFieldKey(t *testing.T) {
+	key := JSONFieldKey("user_id")
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`{"user_id": "abc"}`, "abc"},
+		{`{"user_id": 42}`, "42"},
+		{`{"other": 1}`, ""},
+		{`not json`, ""},
+	}
+	for _, tt := range tests {
+		if got := key(defaultTopic, defaultChannel, &nsq.Message{Body: []byte(tt.body)}); got != tt.want {
+			t.Errorf("JSONFieldKey()(%s) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	rateLimit := NewRateLimit(1, 1)
+	rateLimit.Key = JSONFieldKey("user_id")
+	rateLimit.Policy = SaturationRequeue
+
+	registry := prometheus.NewRegistry()
+	NewPrometheus(WithRegisterer(registry), WithCollectors(rateLimit))
+
+	calls := 0
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(rateLimit)
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		calls++
+		return nil
+	})
+
+	for _, body := range []string{`{"user_id": 1}`, `{"user_id": 2}`} {
+		message, _ := newMockMessage(body)
+		if err := nsqMid.HandleMessage(message); err != nil {
+			t.Errorf("NSQM.HandleMessage() error = %v", err)
+		}
+	}
+
+	message, delegate := newMockMessage(`{"user_id": 1}`)
+	if err := nsqMid.HandleMessage(message); err != ErrRateLimited {
+		t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, ErrRateLimited)
+	}
+
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+
+	if delegate.requeued != 1 || delegate.backoff || delegate.requeueDelay <= 0 || delegate.requeueDelay > time.Second {
+		t.Errorf("message must be requeued without backoff within a second. got: %+v", delegate)
+	}
+
+	// Another instance registered with the same options adds its own topic/channel to the tokens.
+	other := NewRateLimit(1, 10)
+	if err := RegisterCollectors([]prometheus.Collector{other}, WithRegisterer(registry)); err != nil {
+		t.Fatal(err)
+	}
+	otherMid := New(defaultTopic, "other")
+	otherMid.UseContext(other)
+	message, _ = newMockMessage(`{"user_id": 1}`)
+	otherMid.HandleMessage(message)
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if !strings.Contains(body, `nsqm_rate_limited_messages_total{channel="channel_test",topic="topic_test"} 1`) {
+		t.Errorf("body does not contain rate limited messages. got: %s", body)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "nsqm_rate_limit_tokens" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "channel" {
+					tokens[label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+
+	// The bucket of user 1 is the emptiest one.
+	if len(tokens) != 2 || tokens[defaultChannel] >= 1 || tokens["other"] < 9 || tokens["other"] >= 10 {
+		t.Errorf("tokens = %v, want less than 1 on %s and 9 on other", tokens, defaultChannel)
+	}
+}
+
+func TestRateLimit_Sweep(t *testing.T) {
+	rateLimit := NewRateLimit(1000, 1)
+	rateLimit.Key = JSONFieldKey("user_id")
+	rateLimit.SweepInterval = 0
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(rateLimit)
+
+	for i := 0; i < 10; i++ {
+		message, _ := newMockMessage(fmt.Sprintf(`{"user_id": %d}`, i))
+		if err := nsqMid.HandleMessage(message); err != nil {
+			t.Errorf("NSQM.HandleMessage() error = %v", err)
+		}
+	}
+
+	// Each message drained the bucket of its key, so every key is still tracked right after it.
+	time.Sleep(5 * time.Millisecond)
+
+	message, _ := newMockMessage(`{"user_id": 0}`)
+	nsqMid.HandleMessage(message)
+
+	if len(rateLimit.limiters) != 1 {
+		t.Errorf("full limiters must be dropped. got: %d", len(rateLimit.limiters))
+	}
+}
+
+func TestRateLimitMiddlewareWait(t *testing.T) {
+	rateLimit := NewRateLimit(100, 1)
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(rateLimit)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := nsqMid.HandleMessage(&nsq.Message{}); err != nil {
+			t.Errorf("NSQM.HandleMessage() error = %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("messages must wait for tokens. elapsed: %v", elapsed)
+	}
+}
@@ -1,42 +1,113 @@
 package nsqmiddleware
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"runtime"
+	"time"
 
 	"github.com/nsqio/go-nsq"
 )
 
 const panicText = "PANIC: %s\n%s"
 
+// RecoveryAction decides what happens to a message whose handler panicked.
+type RecoveryAction uint32
+
+// These are the different recovery actions.
+const (
+	// RecoveryRequeue requeues the message with Recovery.RequeueDelay.
+	RecoveryRequeue RecoveryAction = iota
+	// RecoveryFinish finishes the message so it is never redelivered.
+	RecoveryFinish
+	// RecoveryDeadLetter passes the message to Recovery.DeadLetter and finishes it.
+	// The message is requeued if the dead-letter handler fails.
+	RecoveryDeadLetter
+)
+
+// DeadLetterFunc receives messages that could not be processed, along with the reason.
+type DeadLetterFunc func(topic, channel string, message *nsq.Message, err error) error
+
+// PanicError is returned by Recovery when the next handler panics.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the panicking goroutine.
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.Value)
+}
+
 // Recovery is a NSQ-Middleware that recovers from any panics.
+// The panic is returned as a *PanicError and the message is responded to according to Action.
 type Recovery struct {
-	Logger     ILogger
-	PrintStack bool
-	StackAll   bool
-	StackSize  int
+	Logger       ILogger
+	PrintStack   bool
+	StackAll     bool
+	StackSize    int
+	Action       RecoveryAction
+	RequeueDelay time.Duration
+	DeadLetter   DeadLetterFunc
 }
 
 // NewRecovery returns a new instance of Recovery.
+// Panicking messages are requeued with the default go-nsq delay.
 func NewRecovery() *Recovery {
 	return &Recovery{
-		Logger:     log.New(os.Stdout, "[nsqm] ", 0),
-		PrintStack: true,
-		StackAll:   false,
-		StackSize:  1024 * 8,
+		Logger:       log.New(os.Stdout, "[nsqm] ", 0),
+		PrintStack:   true,
+		StackAll:     false,
+		StackSize:    1024 * 8,
+		Action:       RecoveryRequeue,
+		RequeueDelay: -1,
 	}
 }
 
-func (recovery *Recovery) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+func (recovery *Recovery) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) (err error) {
 	defer func() {
-		if err := recover(); err != nil {
+		if r := recover(); r != nil {
 			stack := make([]byte, recovery.StackSize)
 			stack = stack[:runtime.Stack(stack, recovery.StackAll)]
 
-			recovery.Logger.Printf(panicText, err, stack)
+			// Middleware running the handler on another goroutine, e.g. Timeout, re-panic with its stack.
+			if panicErr, ok := r.(*PanicError); ok {
+				r, stack = panicErr.Value, panicErr.Stack
+			}
+
+			if recovery.PrintStack {
+				recovery.Logger.Printf(panicText, r, stack)
+			} else {
+				recovery.Logger.Printf("PANIC: %s", r)
+			}
+
+			panicErr := &PanicError{Value: r, Stack: stack}
+			recovery.dispose(topic, channel, message, panicErr)
+			err = panicErr
 		}
 	}()
 
 	return next(message)
 }
+
+func (recovery *Recovery) dispose(topic, channel string, message *nsq.Message, err *PanicError) {
+	switch recovery.Action {
+	case RecoveryFinish:
+		message.Finish()
+	case RecoveryDeadLetter:
+		if recovery.DeadLetter == nil {
+			message.Requeue(recovery.RequeueDelay)
+			return
+		}
+		if dlErr := recovery.DeadLetter(topic, channel, message, err); dlErr != nil {
+			recovery.Logger.Printf("dead letter failed: %s", dlErr)
+			message.Requeue(recovery.RequeueDelay)
+			return
+		}
+		message.Finish()
+	default:
+		message.Requeue(recovery.RequeueDelay)
+	}
+}
@@ -2,6 +2,7 @@ package nsqmiddleware
 
 import (
 	"bytes"
+	"errors"
 	"log"
 	"strings"
 	"testing"
@@ -15,10 +16,12 @@ func TestRecoveryMiddleware(t *testing.T) {
 	recovery := NewRecovery()
 	recovery.Logger = log.New(buff, "[nsqm] ", 0)
 
+	message, delegate := newMockMessage(`{"message": 1}`)
+
 	nsqMid := New(defaultTopic, defaultChannel)
 	nsqMid.Use(recovery)
 	nsqMid.UseHandlerFunc(nsqHandlerFuncPanic)
-	nsqMid.HandleMessage(&nsq.Message{Attempts: 1, Body: []byte(`{"message": 1}`)})
+	err := nsqMid.HandleMessage(message)
 
 	if !strings.Contains(buff.String(), "PANIC") {
 		t.Errorf("log does not contain PANIC")
@@ -27,4 +30,81 @@ func TestRecoveryMiddleware(t *testing.T) {
 	if len(buff.String()) == 0 {
 		t.Errorf("log body must not empty 😱")
 	}
+
+	panicErr, ok := err.(*PanicError)
+	if !ok {
+		t.Fatalf("error must be *PanicError. got: %T", err)
+	}
+
+	if panicErr.Value != "panic at the disco 👨‍🎤" || len(panicErr.Stack) == 0 {
+		t.Errorf("unexpected PanicError: %v", panicErr)
+	}
+
+	if delegate.requeued != 1 || delegate.requeueDelay != -1 {
+		t.Errorf("message must be requeued with default delay. got: %+v", delegate)
+	}
+}
+
+func TestRecovery_Action(t *testing.T) {
+	tests := []struct {
+		name         string
+		action       RecoveryAction
+		deadLetter   DeadLetterFunc
+		wantFinished int
+		wantRequeued int
+	}{
+		{
+			"requeue",
+			RecoveryRequeue,
+			nil,
+			0,
+			1,
+		},
+		{
+			"finish",
+			RecoveryFinish,
+			nil,
+			1,
+			0,
+		},
+		{
+			"dead letter",
+			RecoveryDeadLetter,
+			func(topic, channel string, message *nsq.Message, err error) error { return nil },
+			1,
+			0,
+		},
+		{
+			"dead letter error",
+			RecoveryDeadLetter,
+			func(topic, channel string, message *nsq.Message, err error) error { return errors.New("error") },
+			0,
+			1,
+		},
+		{
+			"dead letter without handler",
+			RecoveryDeadLetter,
+			nil,
+			0,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recovery := NewRecovery()
+			recovery.Logger = log.New(&bytes.Buffer{}, "", 0)
+			recovery.PrintStack = false
+			recovery.Action = tt.action
+			recovery.DeadLetter = tt.deadLetter
+
+			message, delegate := newMockMessage(`{"message": 1}`)
+			if err := recovery.HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncPanic); err == nil {
+				t.Errorf("Recovery.HandleMessage() error must not nil")
+			}
+
+			if delegate.finished != tt.wantFinished || delegate.requeued != tt.wantRequeued {
+				t.Errorf("finished = %d, requeued = %d, want %d, %d", delegate.finished, delegate.requeued, tt.wantFinished, tt.wantRequeued)
+			}
+		})
+	}
 }
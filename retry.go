@@ -0,0 +1,153 @@
+package nsqmiddleware
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// Backoff computes the requeue delay of a message from the number of attempts made so far.
+type Backoff interface {
+	Delay(attempts uint16) time.Duration
+}
+
+// BackoffFunc is an adapter to allow the use of ordinary functions as Backoff.
+type BackoffFunc func(attempts uint16) time.Duration
+
+func (backoffFunc BackoffFunc) Delay(attempts uint16) time.Duration {
+	return backoffFunc(attempts)
+}
+
+// ConstantBackoff returns a Backoff that always waits delay.
+func ConstantBackoff(delay time.Duration) Backoff {
+	return BackoffFunc(func(attempts uint16) time.Duration {
+		return delay
+	})
+}
+
+// ExponentialBackoff returns a Backoff that doubles base on every attempt, capped at max.
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return BackoffFunc(func(attempts uint16) time.Duration {
+		return exponential(base, max, 2, attempts)
+	})
+}
+
+// DecorrelatedJitterBackoff returns a Backoff that waits a random delay between base and
+// three times the previous upper bound, capped at max.
+// Messages carry no state between attempts, so the previous bound is derived from attempts.
+func DecorrelatedJitterBackoff(base, max time.Duration) Backoff {
+	return BackoffFunc(func(attempts uint16) time.Duration {
+		upper := exponential(base, max, 3, attempts)
+		if upper <= base {
+			return upper
+		}
+		return base + time.Duration(rand.Int63n(int64(upper-base)))
+	})
+}
+
+func exponential(base, max time.Duration, factor int64, attempts uint16) time.Duration {
+	delay := base
+	for i := uint16(1); i < attempts; i++ {
+		if delay >= max/time.Duration(factor) {
+			return max
+		}
+		delay *= time.Duration(factor)
+	}
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// PermanentError marks an error that must not be retried.
+type PermanentError struct {
+	Err error
+}
+
+func (err *PermanentError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *PermanentError) Unwrap() error {
+	return err.Err
+}
+
+// Permanent wraps err so that Retry and DeadLetter treat it as a permanent failure.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err, or any error it wraps, is a *PermanentError.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// RetryDefaultMaxAttempts is the max attempts used by the default Retry instance.
+var RetryDefaultMaxAttempts uint16 = 5
+
+// Retry is a middleware handler that owns the response of every message it sees.
+// Successful messages are finished, retryable failures are requeued with Backoff,
+// and permanent failures or messages out of attempts are finished.
+type Retry struct {
+	// Backoff computes the requeue delay. If nil, go-nsq computes it from the number of attempts.
+	Backoff Backoff
+	// MaxAttempts is the number of attempts after which a failing message is finished. Zero means unlimited.
+	MaxAttempts uint16
+	// Retryable classifies errors. Errors for which it returns false are finished right away.
+	Retryable func(err error) bool
+	// WithoutBackoff requeues with RequeueWithoutBackoff so the consumer does not enter backoff.
+	WithoutBackoff bool
+}
+
+// NewRetry returns a new Retry instance with exponential backoff and RetryDefaultMaxAttempts.
+func NewRetry() *Retry {
+	return &Retry{
+		Backoff:     ExponentialBackoff(time.Second, 10*time.Minute),
+		MaxAttempts: RetryDefaultMaxAttempts,
+		Retryable:   func(err error) bool { return !IsPermanent(err) },
+	}
+}
+
+func (retry *Retry) HandleMessage(topic, channel string, message *nsq.Message, next nsq.HandlerFunc) error {
+	message.DisableAutoResponse()
+
+	err := next(message)
+	if message.HasResponded() {
+		return err
+	}
+
+	if err == nil {
+		message.Finish()
+		return nil
+	}
+
+	if !retry.retryable(err) || (retry.MaxAttempts > 0 && message.Attempts >= retry.MaxAttempts) {
+		message.Finish()
+		return err
+	}
+
+	delay := time.Duration(-1)
+	if retry.Backoff != nil {
+		delay = retry.Backoff.Delay(message.Attempts)
+	}
+	if retry.WithoutBackoff {
+		message.RequeueWithoutBackoff(delay)
+	} else {
+		message.Requeue(delay)
+	}
+
+	return err
+}
+
+func (retry *Retry) retryable(err error) bool {
+	if retry.Retryable == nil {
+		return !IsPermanent(err)
+	}
+	return retry.Retryable(err)
+}
@@ -0,0 +1,88 @@
+package nsqmiddleware
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	tests := []struct {
+		name     string
+		backoff  Backoff
+		attempts uint16
+		min      time.Duration
+		max      time.Duration
+	}{
+		{"constant", ConstantBackoff(time.Second), 10, time.Second, time.Second},
+		{"exponential first", ExponentialBackoff(time.Second, time.Minute), 1, time.Second, time.Second},
+		{"exponential third", ExponentialBackoff(time.Second, time.Minute), 3, 4 * time.Second, 4 * time.Second},
+		{"exponential capped", ExponentialBackoff(time.Second, time.Minute), 100, time.Minute, time.Minute},
+		{"jitter first", DecorrelatedJitterBackoff(time.Second, time.Minute), 1, time.Second, time.Second},
+		{"jitter third", DecorrelatedJitterBackoff(time.Second, time.Minute), 3, time.Second, 9 * time.Second},
+		{"jitter capped", DecorrelatedJitterBackoff(time.Second, time.Minute), 100, time.Second, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.backoff.Delay(tt.attempts); got < tt.min || got > tt.max {
+				t.Errorf("Backoff.Delay() = %v, want between %v and %v", got, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	if !IsPermanent(fmt.Errorf("wrapped: %w", Permanent(errors.New("error")))) {
+		t.Errorf("IsPermanent() must be true for wrapped permanent error")
+	}
+
+	if IsPermanent(errors.New("error")) {
+		t.Errorf("IsPermanent() must be false for plain error")
+	}
+
+	if Permanent(nil) != nil {
+		t.Errorf("Permanent(nil) must be nil")
+	}
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     uint16
+		err          error
+		wantFinished int
+		wantRequeued int
+		wantDelay    time.Duration
+	}{
+		{"success", 1, nil, 1, 0, 0},
+		{"retryable", 2, errors.New("error"), 0, 1, 2 * time.Second},
+		{"permanent", 1, Permanent(errors.New("error")), 1, 0, 0},
+		{"out of attempts", 5, errors.New("error"), 1, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry := NewRetry()
+			retry.Backoff = ExponentialBackoff(time.Second, time.Minute)
+
+			message, delegate := newMockMessage(`{"message": 1}`)
+			message.Attempts = tt.attempts
+
+			nsqMid := New(defaultTopic, defaultChannel)
+			nsqMid.Use(retry)
+			nsqMid.Use(mockMiddleware{err: tt.err})
+
+			if err := nsqMid.HandleMessage(message); err != tt.err {
+				t.Errorf("NSQM.HandleMessage() error = %v, want %v", err, tt.err)
+			}
+
+			if !message.IsAutoResponseDisabled() {
+				t.Errorf("auto response must be disabled")
+			}
+
+			if delegate.finished != tt.wantFinished || delegate.requeued != tt.wantRequeued || delegate.requeueDelay != tt.wantDelay {
+				t.Errorf("got %+v, want finished = %d, requeued = %d, delay = %v", delegate, tt.wantFinished, tt.wantRequeued, tt.wantDelay)
+			}
+		})
+	}
+}
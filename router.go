@@ -0,0 +1,124 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ErrNoRoute is returned, wrapped by Permanent, by Router for messages matching no route when there is no fallback.
+var ErrNoRoute = errors.New("nsqm: no route for message")
+
+const (
+	routeFallback = "fallback"
+	routeNone     = "none"
+)
+
+// PrefixKey returns a KeyFunc that extracts the first of prefixes the body starts with.
+// Bodies starting with none of them get an empty key.
+func PrefixKey(prefixes ...string) KeyFunc {
+	return func(topic, channel string, message *nsq.Message) string {
+		for _, prefix := range prefixes {
+			if bytes.HasPrefix(message.Body, []byte(prefix)) {
+				return prefix
+			}
+		}
+		return ""
+	}
+}
+
+// Router is a context-aware middleware handler that dispatches messages to a NSQM per route.
+// The route of a message is the key extracted by Classify, e.g. with JSONFieldKey or PrefixKey.
+// Messages matching no route go to the fallback NSQM. The next handler is called once the route succeeds.
+//
+// Router is a prometheus.Collector exposing the messages dispatched per route.
+type Router struct {
+	// Classify extracts the route of a message.
+	Classify KeyFunc
+
+	mu       sync.RWMutex
+	routes   map[string]*NSQM
+	fallback *NSQM
+	messages atomic.Pointer[prometheus.CounterVec]
+}
+
+// NewRouter returns a new Router instance with no route, classifying messages with classify.
+func NewRouter(classify KeyFunc) *Router {
+	return &Router{Classify: classify}
+}
+
+func newRouterMessages(config *prometheusConfig) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts(config.opts("router", "messages_total",
+		"How many messages were routed, partitioned by topic, channel and route. Unrouted messages have the route none.")),
+		[]string{"topic", "channel", "route"},
+	)
+}
+
+// Handle dispatches the messages of route to nsqm.
+func (router *Router) Handle(route string, nsqm *NSQM) {
+	if nsqm == nil {
+		panic("nsqm cannot be nil")
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if router.routes == nil {
+		router.routes = map[string]*NSQM{}
+	}
+	router.routes[route] = nsqm
+}
+
+// Fallback dispatches the messages matching no route to nsqm.
+func (router *Router) Fallback(nsqm *NSQM) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	router.fallback = nsqm
+}
+
+func (router *Router) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	route := router.Classify(topic, channel, message)
+
+	router.mu.RLock()
+	nsqm, ok := router.routes[route]
+	if !ok {
+		nsqm, route = router.fallback, routeFallback
+	}
+	router.mu.RUnlock()
+
+	messages := loadMetrics(&router.messages, newRouterMessages)
+	if nsqm == nil {
+		messages.WithLabelValues(topic, channel, routeNone).Inc()
+		return Permanent(ErrNoRoute)
+	}
+	messages.WithLabelValues(topic, channel, route).Inc()
+
+	if err := nsqm.HandleMessageContext(ctx, message); err != nil {
+		return err
+	}
+	return next(ctx, message)
+}
+
+func (router *Router) shareMetrics(config *prometheusConfig) error {
+	messages := newRouterMessages(config)
+	if err := shareCollector(config.registerer, &messages); err != nil {
+		return err
+	}
+
+	router.messages.Store(messages)
+	return nil
+}
+
+func (router *Router) Describe(ch chan<- *prometheus.Desc) {
+	loadMetrics(&router.messages, newRouterMessages).Describe(ch)
+}
+
+func (router *Router) Collect(ch chan<- prometheus.Metric) {
+	loadMetrics(&router.messages, newRouterMessages).Collect(ch)
+}
@@ -0,0 +1,67 @@
+package nsqmiddleware
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestRouterMiddleware(t *testing.T) {
+	var got []string
+	route := func(name string) *NSQM {
+		return New(defaultTopic, defaultChannel, WrapHandler(nsq.HandlerFunc(func(message *nsq.Message) error {
+			got = append(got, name)
+			return nil
+		})))
+	}
+
+	router := NewRouter(JSONFieldKey("type"))
+	router.Handle("created", route("created"))
+	router.Handle("deleted", route("deleted"))
+	router.Fallback(route("fallback"))
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(router)
+
+	for _, body := range []string{`{"type": "created"}`, `{"type": "deleted"}`, `{"type": "updated"}`, `{"type": "created"}`} {
+		message, _ := newMockMessage(body)
+		if err := nsqMid.HandleMessage(message); err != nil {
+			t.Errorf("NSQM.HandleMessage() error = %v", err)
+		}
+	}
+
+	if strings.Join(got, ",") != "created,deleted,fallback,created" {
+		t.Errorf("routes = %v", got)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(router)
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if !strings.Contains(body, `nsqm_router_messages_total{channel="channel_test",route="created",topic="topic_test"} 2`) {
+		t.Errorf("routed messages must be counted. got: %s", body)
+	}
+	if !strings.Contains(body, `nsqm_router_messages_total{channel="channel_test",route="fallback",topic="topic_test"} 1`) {
+		t.Errorf("fallback messages must be counted. got: %s", body)
+	}
+}
+
+func TestRouter_NoRoute(t *testing.T) {
+	router := NewRouter(PrefixKey("v1:", "v2:"))
+	router.Handle("v1:", New(defaultTopic, defaultChannel))
+
+	message, _ := newMockMessage(`v1:body`)
+	if err := WrapContextHandler(router).HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess); err != nil {
+		t.Errorf("Router.HandleMessage() error = %v", err)
+	}
+
+	message, _ = newMockMessage(`v2:body`)
+	err := WrapContextHandler(router).HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess)
+	if !errors.Is(err, ErrNoRoute) || !IsPermanent(err) {
+		t.Errorf("Router.HandleMessage() error = %v, want permanent %v", err, ErrNoRoute)
+	}
+}
@@ -0,0 +1,148 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Field is a key/value pair of a structured log entry.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// StructuredSink receives the structured entries logged by Logger.
+type StructuredSink interface {
+	Log(level Level, fields []Field)
+}
+
+// Encoder encodes the fields of a structured log entry into a single line.
+type Encoder interface {
+	Encode(fields []Field) ([]byte, error)
+}
+
+// JSONEncoder encodes fields as a JSON object, keeping the order of the fields.
+type JSONEncoder struct{}
+
+func (JSONEncoder) Encode(fields []Field) ([]byte, error) {
+	buff := &bytes.Buffer{}
+	buff.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buff.WriteByte(',')
+		}
+
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(fieldValue(field.Value))
+		if err != nil {
+			return nil, err
+		}
+
+		buff.Write(key)
+		buff.WriteByte(':')
+		buff.Write(value)
+	}
+	buff.WriteByte('}')
+	return buff.Bytes(), nil
+}
+
+// LogfmtEncoder encodes fields as logfmt key=value pairs.
+type LogfmtEncoder struct{}
+
+func (LogfmtEncoder) Encode(fields []Field) ([]byte, error) {
+	buff := &bytes.Buffer{}
+	for i, field := range fields {
+		if i > 0 {
+			buff.WriteByte(' ')
+		}
+
+		value := fmt.Sprint(fieldValue(field.Value))
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+
+		buff.WriteString(field.Key)
+		buff.WriteByte('=')
+		buff.WriteString(value)
+	}
+	return buff.Bytes(), nil
+}
+
+// fieldValue converts values that have no useful JSON or logfmt representation.
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	}
+	return value
+}
+
+type encoderSink struct {
+	mu      sync.Mutex
+	writer  io.Writer
+	encoder Encoder
+}
+
+// NewEncoderSink returns a StructuredSink that writes each entry encoded by encoder on its own line.
+func NewEncoderSink(writer io.Writer, encoder Encoder) StructuredSink {
+	return &encoderSink{writer: writer, encoder: encoder}
+}
+
+// NewJSONSink returns a StructuredSink that writes JSON lines to writer.
+func NewJSONSink(writer io.Writer) StructuredSink {
+	return NewEncoderSink(writer, JSONEncoder{})
+}
+
+// NewLogfmtSink returns a StructuredSink that writes logfmt lines to writer.
+func NewLogfmtSink(writer io.Writer) StructuredSink {
+	return NewEncoderSink(writer, LogfmtEncoder{})
+}
+
+func (sink *encoderSink) Log(level Level, fields []Field) {
+	line, err := sink.encoder.Encode(fields)
+	if err != nil {
+		return
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	sink.writer.Write(append(line, '\n'))
+}
+
+type slogSink struct {
+	logger *slog.Logger
+}
+
+// NewSlogSink returns a StructuredSink that logs to logger.
+// SuccessLevel entries are logged at slog.LevelInfo and ErrorLevel entries at slog.LevelError.
+func NewSlogSink(logger *slog.Logger) StructuredSink {
+	return slogSink{logger: logger}
+}
+
+func (sink slogSink) Log(level Level, fields []Field) {
+	slogLevel := slog.LevelInfo
+	if level >= ErrorLevel {
+		slogLevel = slog.LevelError
+	}
+
+	attrs := make([]slog.Attr, 0, len(fields))
+	for _, field := range fields {
+		attrs = append(attrs, slog.Any(field.Key, field.Value))
+	}
+
+	sink.logger.LogAttrs(context.Background(), slogLevel, "nsq message", attrs...)
+}
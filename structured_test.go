@@ -0,0 +1,54 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testFields = []Field{
+	{"topic", "topic_test"},
+	{"attempts", uint16(2)},
+	{"duration", 1500 * time.Millisecond},
+	{"error", errors.New("100% failed")},
+}
+
+func TestJSONEncoder_Encode(t *testing.T) {
+	got, err := JSONEncoder{}.Encode(testFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"topic":"topic_test","attempts":2,"duration":"1.5s","error":"100% failed"}`
+	if string(got) != want {
+		t.Errorf("JSONEncoder.Encode() = %s, want %s", got, want)
+	}
+}
+
+func TestLogfmtEncoder_Encode(t *testing.T) {
+	got, err := LogfmtEncoder{}.Encode(testFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `topic=topic_test attempts=2 duration=1.5s error="100% failed"`
+	if string(got) != want {
+		t.Errorf("LogfmtEncoder.Encode() = %s, want %s", got, want)
+	}
+}
+
+func TestSlogSink_Log(t *testing.T) {
+	var buff bytes.Buffer
+
+	sink := NewSlogSink(slog.New(slog.NewTextHandler(&buff, nil)))
+	sink.Log(ErrorLevel, testFields)
+
+	for _, want := range []string{"level=ERROR", "topic=topic_test", "attempts=2", "duration=1.5s", `error="100% failed"`} {
+		if !strings.Contains(buff.String(), want) {
+			t.Errorf("log does not contain %s. got: %s", want, buff.String())
+		}
+	}
+}
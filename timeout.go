@@ -0,0 +1,129 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+// TimeoutError is returned by Timeout when the next handler does not return before the deadline.
+type TimeoutError struct {
+	// Timeout is the deadline the handler was given.
+	Timeout time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("nsqm: handler timed out after %s", err.Timeout)
+}
+
+// Unwrap returns context.DeadlineExceeded, so errors.Is matches it.
+func (err *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// Timeout is a context-aware middleware handler that runs the rest of the chain under a deadline.
+// While the handler is working, the message is touched every TouchInterval so nsqd does not
+// redeliver it, until MaxTouch has elapsed.
+//
+// When the deadline is hit, the message context is canceled and a *TimeoutError is returned right away,
+// leaving the response to go-nsq or to the outer middleware. The handler keeps running until it
+// notices the cancellation, so it should use WrapHandlerContextFunc or be a ContextHandler.
+//
+// The handler runs on its own goroutine. A panic is raised again on the calling goroutine as a *PanicError
+// holding the stack of the handler, which Recovery keeps. A panic after the deadline is logged to Logger.
+type Timeout struct {
+	Logger ILogger
+	// Timeout is the deadline of the handler. Zero means no deadline, only heartbeats.
+	Timeout time.Duration
+	// TouchInterval is how often the message is touched. Zero disables touching.
+	// It should be lower than the msg_timeout of nsqd.
+	TouchInterval time.Duration
+	// MaxTouch is how long after the start of the handler the message is still touched. Zero means until Timeout.
+	MaxTouch time.Duration
+}
+
+// NewTimeout returns a new Timeout instance with a timeout deadline that touches the message every 30 seconds,
+// half of the default msg_timeout of nsqd.
+func NewTimeout(timeout time.Duration) *Timeout {
+	return &Timeout{
+		Logger:        log.New(os.Stdout, "[nsqm] ", 0),
+		Timeout:       timeout,
+		TouchInterval: 30 * time.Second,
+	}
+}
+
+func (timeout *Timeout) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	cancel := context.CancelFunc(func() {})
+	if timeout.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout.Timeout)
+	}
+	defer cancel()
+
+	done := make(chan error, 1)
+	panicked := make(chan *PanicError)
+	returned := make(chan struct{})
+	defer close(returned)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr := &PanicError{Value: r, Stack: debug.Stack()}
+				select {
+				case panicked <- panicErr:
+				case <-returned:
+					if timeout.Logger != nil {
+						timeout.Logger.Printf("PANIC after timeout: %s\n%s", r, panicErr.Stack)
+					}
+				}
+			}
+		}()
+		done <- next(ctx, message)
+	}()
+
+	var touch <-chan time.Time
+	if timeout.TouchInterval > 0 {
+		ticker := time.NewTicker(timeout.TouchInterval)
+		defer ticker.Stop()
+		touch = ticker.C
+	}
+
+	start := time.Now()
+	for {
+		select {
+		case err := <-done:
+			return timeout.result(ctx, err)
+		case panicErr := <-panicked:
+			// Re-panic on the calling goroutine so Recovery can handle it.
+			panic(panicErr)
+		case <-touch:
+			if timeout.MaxTouch > 0 && time.Since(start) >= timeout.MaxTouch {
+				touch = nil
+				continue
+			}
+			if !message.HasResponded() {
+				message.Touch()
+			}
+		case <-ctx.Done():
+			// A handler that made it right before the deadline still succeeds.
+			select {
+			case err := <-done:
+				return timeout.result(ctx, err)
+			default:
+				return timeout.result(ctx, ctx.Err())
+			}
+		}
+	}
+}
+
+// result replaces the error of a handler that failed because of the deadline with a *TimeoutError.
+func (timeout *Timeout) result(ctx context.Context, err error) error {
+	if err != nil && timeout.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{Timeout: timeout.Timeout}
+	}
+	return err
+}
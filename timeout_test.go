@@ -0,0 +1,124 @@
+package nsqmiddleware
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	canceled := make(chan struct{})
+
+	timeout := NewTimeout(50 * time.Millisecond)
+	timeout.TouchInterval = 10 * time.Millisecond
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(timeout)
+	nsqMid.UseHandlerContextFunc(func(ctx context.Context, message *nsq.Message) error {
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	})
+
+	message, delegate := newMockMessage(`{"message": 1}`)
+	err := nsqMid.HandleMessage(message)
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("NSQM.HandleMessage() error = %v, want *TimeoutError", err)
+	}
+	if timeoutErr.Timeout != 50*time.Millisecond {
+		t.Errorf("TimeoutError.Timeout = %v, want %v", timeoutErr.Timeout, 50*time.Millisecond)
+	}
+	if delegate.touched < 2 {
+		t.Errorf("message must be touched while the handler is working. got: %d touches", delegate.touched)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Errorf("handler context must be canceled")
+	}
+}
+
+func TestTimeout_MaxTouch(t *testing.T) {
+	timeout := &Timeout{TouchInterval: 5 * time.Millisecond, MaxTouch: 12 * time.Millisecond}
+
+	message, delegate := newMockMessage(`{"message": 1}`)
+	err := timeout.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, message, func(ctx context.Context, message *nsq.Message) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+
+	if err != nil {
+		t.Errorf("Timeout.HandleMessageContext() error = %v", err)
+	}
+	if delegate.touched == 0 || delegate.touched > 3 {
+		t.Errorf("message must be touched until MaxTouch only. got: %d touches", delegate.touched)
+	}
+}
+
+func TestTimeout_Panic(t *testing.T) {
+	recovery := NewRecovery()
+	recovery.Logger = log.New(&bytes.Buffer{}, "", 0)
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.Use(recovery)
+	nsqMid.UseContext(NewTimeout(time.Second))
+	nsqMid.UseHandlerFunc(timeoutTestPanic)
+
+	message, _ := newMockMessage(`{"message": 1}`)
+	err := nsqMid.HandleMessage(message)
+
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("NSQM.HandleMessage() error = %v, want *PanicError", err)
+	}
+	if panicErr.Value != "panic" || !strings.Contains(string(panicErr.Stack), "timeoutTestPanic") {
+		t.Errorf("panic must keep the value and the stack of the handler. got: %v\n%s", panicErr.Value, panicErr.Stack)
+	}
+}
+
+func timeoutTestPanic(message *nsq.Message) error {
+	panic("panic")
+}
+
+type chanWriter chan string
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- string(p)
+	return len(p), nil
+}
+
+func TestTimeout_PanicAfterDeadline(t *testing.T) {
+	logs := make(chanWriter, 1)
+
+	timeout := NewTimeout(10 * time.Millisecond)
+	timeout.Logger = log.New(logs, "", 0)
+
+	err := timeout.HandleMessageContext(context.Background(), defaultTopic, defaultChannel, &nsq.Message{}, func(ctx context.Context, message *nsq.Message) error {
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		panic("late")
+	})
+
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Errorf("Timeout.HandleMessageContext() error = %v, want *TimeoutError", err)
+	}
+
+	select {
+	case line := <-logs:
+		if !strings.HasPrefix(line, "PANIC after timeout: late") {
+			t.Errorf("late panic log = %s", line)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("late panic must be logged")
+	}
+}
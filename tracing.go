@@ -0,0 +1,135 @@
+package nsqmiddleware
+
+import (
+	"context"
+
+	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ariefrahmansyah/nsq-middleware"
+
+// Tracing is a context-aware middleware handler that starts a consumer span per message.
+// The trace context of the publisher travels as Envelope headers, e.g. traceparent. When the message
+// carries one, the span is a child of the publishing span. Enveloped bodies are unwrapped before calling
+// the next handler, exposing their headers with HeadersFromContext like UnwrapEnvelope does, so both
+// can be used in any order. Other bodies pass through untouched.
+type Tracing struct {
+	Tracer     trace.Tracer
+	Propagator propagation.TextMapPropagator
+	// EnvelopeFormat is the format of the envelopes of the bodies published without one.
+	EnvelopeFormat EnvelopeFormat
+}
+
+// NewTracing returns a new Tracing instance using the global tracer provider and the W3C trace context propagator.
+func NewTracing() *Tracing {
+	return &Tracing{
+		Tracer:     otel.GetTracerProvider().Tracer(tracerName),
+		Propagator: propagation.TraceContext{},
+	}
+}
+
+func (tracing *Tracing) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	ctx = tracing.extract(ctx, message)
+
+	ctx, span := tracing.Tracer.Start(ctx, topic+" process",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nsq"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("messaging.consumer.group.name", channel),
+			attribute.String("messaging.message.id", string(message.ID[:])),
+			attribute.Int("messaging.nsq.attempts", int(message.Attempts)),
+		),
+	)
+	defer span.End()
+
+	err := next(ctx, message)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("nsqm.status", "error"))
+	} else {
+		span.SetAttributes(attribute.String("nsqm.status", "ok"))
+	}
+
+	return err
+}
+
+// extract returns ctx with the trace context of the publisher of message, unwrapping its body if needed.
+func (tracing *Tracing) extract(ctx context.Context, message *nsq.Message) context.Context {
+	headers := HeadersFromContext(ctx)
+	if headers == nil {
+		if envelope, ok, err := ParseEnvelope(message.Body); ok && err == nil {
+			// Malformed envelopes are left to UnwrapEnvelope.
+			headers = envelope.Headers
+			ctx = ContextWithHeaders(ctx, headers)
+			message.Body = envelope.Body
+		}
+	}
+
+	if headers == nil {
+		return ctx
+	}
+	return tracing.Propagator.Extract(ctx, propagation.MapCarrier(headers))
+}
+
+// WrapBody wraps body in an envelope carrying the trace context of ctx as headers.
+// A body that is already enveloped gets the trace context added to its headers.
+func (tracing *Tracing) WrapBody(ctx context.Context, body []byte) ([]byte, error) {
+	carrier := propagation.MapCarrier{}
+	tracing.Propagator.Inject(ctx, carrier)
+
+	return addEnvelopeHeaders(body, tracing.EnvelopeFormat, carrier, true)
+}
+
+// HandlePublish starts a producer span and wraps every body with its trace context,
+// so Tracing can be used in a ProducerChain, before or after WrapEnvelope.
+func (tracing *Tracing) HandlePublish(ctx context.Context, publishing *Publishing, next PublishFunc) error {
+	ctx, span := tracing.Tracer.Start(ctx, publishing.Topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "nsq"),
+			attribute.String("messaging.destination.name", publishing.Topic),
+			attribute.Int("messaging.batch.message_count", len(publishing.Bodies)),
+		),
+	)
+	defer span.End()
+
+	err := tracing.wrapBodies(ctx, publishing)
+	if err == nil {
+		err = next(ctx, publishing)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+func (tracing *Tracing) wrapBodies(ctx context.Context, publishing *Publishing) error {
+	bodies := make([][]byte, len(publishing.Bodies))
+	for i, body := range publishing.Bodies {
+		wrapped, err := tracing.WrapBody(ctx, body)
+		if err != nil {
+			return err
+		}
+		bodies[i] = wrapped
+	}
+	publishing.Bodies = bodies
+	return nil
+}
+
+// Publish starts a producer span, wraps body with its trace context and publishes it to topic.
+func (tracing *Tracing) Publish(ctx context.Context, publisher Publisher, topic string, body []byte) error {
+	publishing := &Publishing{Kind: PublishSingle, Topic: topic, Bodies: [][]byte{body}}
+	return tracing.HandlePublish(ctx, publishing, func(ctx context.Context, publishing *Publishing) error {
+		return publisher.Publish(publishing.Topic, publishing.body())
+	})
+}
@@ -0,0 +1,180 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nsqio/go-nsq"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func newTestTracing() (*Tracing, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	tracing := NewTracing()
+	tracing.Tracer = provider.Tracer(tracerName)
+	return tracing, exporter
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	tracing, exporter := newTestTracing()
+	publisher := NewMemoryPublisher()
+
+	if err := tracing.Publish(context.Background(), publisher, defaultTopic, []byte(`{"message": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	var body string
+	var spanContext trace.SpanContext
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(tracing)
+	nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+		body = string(message.Body)
+		spanContext = trace.SpanContextFromContext(ctx)
+		return errors.New("error")
+	})
+
+	nsqMid.HandleMessage(&nsq.Message{Attempts: 2, Body: publisher.Messages()[0].Body})
+
+	if body != `{"message": 1}` {
+		t.Errorf("body must be unwrapped. got: %s", body)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("spans = %d, want 2", len(spans))
+	}
+
+	producer, consumer := spans[0], spans[1]
+	if consumer.Parent.SpanID() != producer.SpanContext.SpanID() || consumer.SpanContext.TraceID() != producer.SpanContext.TraceID() {
+		t.Errorf("consumer span must be a child of the producer span")
+	}
+
+	if spanContext.SpanID() != consumer.SpanContext.SpanID() {
+		t.Errorf("next handler must receive the consumer span context")
+	}
+
+	if consumer.SpanKind != trace.SpanKindConsumer || consumer.Status.Code != codes.Error {
+		t.Errorf("unexpected consumer span: %v %v", consumer.SpanKind, consumer.Status)
+	}
+
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range consumer.Attributes {
+		attributes[kv.Key] = kv.Value
+	}
+
+	if attributes["messaging.destination.name"].AsString() != defaultTopic ||
+		attributes["messaging.consumer.group.name"].AsString() != defaultChannel ||
+		attributes["messaging.nsq.attempts"].AsInt64() != 2 ||
+		attributes["nsqm.status"].AsString() != "error" {
+		t.Errorf("unexpected consumer span attributes: %v", attributes)
+	}
+}
+
+func TestTracingMiddlewarePassthrough(t *testing.T) {
+	tracing, exporter := newTestTracing()
+
+	var body string
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(tracing)
+	nsqMid.UseHandlerFunc(func(message *nsq.Message) error {
+		body = string(message.Body)
+		return nil
+	})
+
+	nsqMid.HandleMessage(&nsq.Message{Body: []byte(`{"message": 1}`)})
+
+	if body != `{"message": 1}` {
+		t.Errorf("body must be untouched. got: %s", body)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Parent.IsValid() {
+		t.Errorf("expected one root consumer span. got: %v", spans)
+	}
+}
+
+func TestTracing_HandlePublish(t *testing.T) {
+	tracing, exporter := newTestTracing()
+	publisher := NewMemoryPublisher()
+
+	chain := NewProducerChain(publisher, tracing)
+	if err := chain.MultiPublish(defaultTopic, [][]byte{[]byte(`{"message": 1}`), []byte(`{"message": 2}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(tracing)
+	for _, m := range publisher.Messages() {
+		nsqMid.HandleMessage(&nsq.Message{Body: m.Body})
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("spans = %d, want 3", len(spans))
+	}
+
+	for _, consumer := range spans[1:] {
+		if consumer.Parent.SpanID() != spans[0].SpanContext.SpanID() {
+			t.Errorf("consumer span must be a child of the producer span")
+		}
+	}
+}
+
+func TestTracing_Envelope(t *testing.T) {
+	orders := map[string]bool{"tracing first": true, "envelope first": false}
+	for name, tracingFirst := range orders {
+		t.Run(name, func(t *testing.T) {
+			tracing, exporter := newTestTracing()
+			publisher := NewMemoryPublisher()
+
+			wrap := NewWrapEnvelope(EnvelopeJSON)
+			wrap.Headers = map[string]string{"tenant": "acme"}
+
+			chain := NewProducerChain(publisher, wrap, tracing)
+			if tracingFirst {
+				chain = NewProducerChain(publisher, tracing, wrap)
+			}
+			if err := chain.Publish(defaultTopic, []byte(`{"message": 1}`)); err != nil {
+				t.Fatal(err)
+			}
+
+			var headers map[string]string
+			var body string
+
+			nsqMid := New(defaultTopic, defaultChannel)
+			if tracingFirst {
+				nsqMid.UseContext(tracing)
+				nsqMid.UseContext(NewUnwrapEnvelope())
+			} else {
+				nsqMid.UseContext(NewUnwrapEnvelope())
+				nsqMid.UseContext(tracing)
+			}
+			nsqMid.UseContextFunc(func(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+				headers, body = HeadersFromContext(ctx), string(message.Body)
+				return next(ctx, message)
+			})
+			nsqMid.HandleMessage(&nsq.Message{Body: publisher.Messages()[0].Body})
+
+			if body != `{"message": 1}` {
+				t.Errorf("body must be unwrapped once. got: %s", body)
+			}
+			if headers["tenant"] != "acme" || headers["traceparent"] == "" {
+				t.Errorf("headers must carry the trace context. got: %v", headers)
+			}
+
+			spans := exporter.GetSpans()
+			if len(spans) != 2 || spans[1].Parent.SpanID() != spans[0].SpanContext.SpanID() {
+				t.Errorf("consumer span must be a child of the producer span")
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package nsqmiddleware
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/nsqio/go-nsq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// FieldViolation describes why a field of a message body is invalid.
+type FieldViolation struct {
+	// Field is the path of the field, e.g. "order.items.0.price". It is "(root)" for the whole body.
+	Field   string
+	Message string
+}
+
+// ValidationError is returned by Validate for messages whose body is invalid.
+type ValidationError struct {
+	Topic      string
+	Violations []FieldViolation
+}
+
+func (err *ValidationError) Error() string {
+	violations := make([]string, len(err.Violations))
+	for i, violation := range err.Violations {
+		violations[i] = violation.Field + ": " + violation.Message
+	}
+	return fmt.Sprintf("nsqm: invalid %s message: %s", err.Topic, strings.Join(violations, "; "))
+}
+
+// BodyValidator validates message bodies.
+type BodyValidator interface {
+	// ValidateBody returns the violations of body, or none if it is valid.
+	ValidateBody(body []byte) []FieldViolation
+}
+
+// JSONSchema is a BodyValidator checking JSON bodies against a JSON Schema.
+type JSONSchema struct {
+	schema *gojsonschema.Schema
+}
+
+// NewJSONSchema compiles the JSON Schema document schema.
+func NewJSONSchema(schema string) (*JSONSchema, error) {
+	compiled, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSchema{schema: compiled}, nil
+}
+
+func (schema *JSONSchema) ValidateBody(body []byte) []FieldViolation {
+	result, err := schema.schema.Validate(gojsonschema.NewBytesLoader(body))
+	if err != nil {
+		return []FieldViolation{{Field: "(root)", Message: err.Error()}}
+	}
+
+	var violations []FieldViolation
+	for _, resultErr := range result.Errors() {
+		violations = append(violations, FieldViolation{Field: resultErr.Field(), Message: resultErr.Description()})
+	}
+	return violations
+}
+
+// StructValidator is a BodyValidator decoding bodies into a struct and checking its `validate` tags
+// with github.com/go-playground/validator.
+type StructValidator struct {
+	typ      reflect.Type
+	codec    Codec
+	validate *validator.Validate
+}
+
+// NewStructValidator returns a new StructValidator decoding bodies with codec into values of the type of prototype.
+func NewStructValidator(prototype interface{}, codec Codec) *StructValidator {
+	typ := reflect.TypeOf(prototype)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return &StructValidator{typ: typ, codec: codec, validate: validator.New()}
+}
+
+func (sv *StructValidator) ValidateBody(body []byte) []FieldViolation {
+	v := reflect.New(sv.typ).Interface()
+	if err := sv.codec.Unmarshal(body, v); err != nil {
+		return []FieldViolation{{Field: "(root)", Message: err.Error()}}
+	}
+
+	err := sv.validate.Struct(v)
+	if err == nil {
+		return nil
+	}
+
+	fieldErrs, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return []FieldViolation{{Field: "(root)", Message: err.Error()}}
+	}
+
+	violations := make([]FieldViolation, len(fieldErrs))
+	for i, fieldErr := range fieldErrs {
+		violations[i] = FieldViolation{Field: fieldErr.Namespace(), Message: fieldErr.Error()}
+	}
+	return violations
+}
+
+// Validate is a context-aware middleware handler that validates the body of messages with the
+// BodyValidator registered for their topic. Invalid messages are not passed to the next handler:
+// a *ValidationError wrapped by Permanent is returned instead, so Retry and DeadLetter do not retry them.
+// Messages of topics without a validator pass through.
+//
+// Validate is a prometheus.Collector exposing the rejected messages.
+type Validate struct {
+	mu         sync.RWMutex
+	validators map[string]BodyValidator
+	rejected   atomic.Pointer[prometheus.CounterVec]
+}
+
+// NewValidate returns a new Validate instance with no validator registered.
+func NewValidate() *Validate {
+	return &Validate{}
+}
+
+func newValidationRejected(config *prometheusConfig) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts(config.opts("validation", "rejected_total",
+		"How many messages were rejected as invalid, partitioned by topic and channel.")),
+		[]string{"topic", "channel"},
+	)
+}
+
+// Register validates the messages of topic with bodyValidator.
+func (validate *Validate) Register(topic string, bodyValidator BodyValidator) {
+	validate.mu.Lock()
+	defer validate.mu.Unlock()
+
+	if validate.validators == nil {
+		validate.validators = map[string]BodyValidator{}
+	}
+	validate.validators[topic] = bodyValidator
+}
+
+// RegisterSchema validates the messages of topic against the JSON Schema document schema.
+func (validate *Validate) RegisterSchema(topic, schema string) error {
+	jsonSchema, err := NewJSONSchema(schema)
+	if err != nil {
+		return err
+	}
+
+	validate.Register(topic, jsonSchema)
+	return nil
+}
+
+// RegisterStruct validates the messages of topic by decoding them as JSON into the type of prototype
+// and checking its struct tags.
+func (validate *Validate) RegisterStruct(topic string, prototype interface{}) {
+	validate.Register(topic, NewStructValidator(prototype, JSONCodec{}))
+}
+
+func (validate *Validate) HandleMessageContext(ctx context.Context, topic, channel string, message *nsq.Message, next NextFunc) error {
+	validate.mu.RLock()
+	bodyValidator, ok := validate.validators[topic]
+	validate.mu.RUnlock()
+
+	if ok {
+		if violations := bodyValidator.ValidateBody(message.Body); len(violations) > 0 {
+			loadMetrics(&validate.rejected, newValidationRejected).WithLabelValues(topic, channel).Inc()
+			return Permanent(&ValidationError{Topic: topic, Violations: violations})
+		}
+	}
+
+	return next(ctx, message)
+}
+
+func (validate *Validate) shareMetrics(config *prometheusConfig) error {
+	rejected := newValidationRejected(config)
+	if err := shareCollector(config.registerer, &rejected); err != nil {
+		return err
+	}
+
+	validate.rejected.Store(rejected)
+	return nil
+}
+
+func (validate *Validate) Describe(ch chan<- *prometheus.Desc) {
+	loadMetrics(&validate.rejected, newValidationRejected).Describe(ch)
+}
+
+func (validate *Validate) Collect(ch chan<- prometheus.Metric) {
+	loadMetrics(&validate.rejected, newValidationRejected).Collect(ch)
+}
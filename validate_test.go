@@ -0,0 +1,86 @@
+package nsqmiddleware
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const validateTestSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string"},
+		"count": {"type": "integer", "minimum": 1}
+	},
+	"required": ["name"]
+}`
+
+type validateTestOrder struct {
+	Name  string `json:"name" validate:"required"`
+	Count int    `json:"count" validate:"min=1"`
+}
+
+func TestValidateMiddleware(t *testing.T) {
+	validate := NewValidate()
+	if err := validate.RegisterSchema(defaultTopic, validateTestSchema); err != nil {
+		t.Fatalf("Validate.RegisterSchema() error = %v", err)
+	}
+
+	nsqMid := New(defaultTopic, defaultChannel)
+	nsqMid.UseContext(validate)
+	nsqMid.UseHandler(nsqHandlerFuncSuccess)
+
+	message, _ := newMockMessage(`{"name": "order", "count": 1}`)
+	if err := nsqMid.HandleMessage(message); err != nil {
+		t.Errorf("NSQM.HandleMessage() error = %v", err)
+	}
+
+	message, _ = newMockMessage(`{"count": 0}`)
+	err := nsqMid.HandleMessage(message)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || !IsPermanent(err) {
+		t.Fatalf("NSQM.HandleMessage() error = %v, want permanent *ValidationError", err)
+	}
+	if len(validationErr.Violations) != 2 {
+		t.Errorf("violations = %+v, want 2", validationErr.Violations)
+	}
+
+	message, _ = newMockMessage(`not json`)
+	if err := nsqMid.HandleMessage(message); !errors.As(err, &validationErr) {
+		t.Errorf("NSQM.HandleMessage() error = %v, want *ValidationError", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(validate)
+
+	body := scrape(t, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	if !strings.Contains(body, `nsqm_validation_rejected_total{channel="channel_test",topic="topic_test"} 2`) {
+		t.Errorf("rejections must be counted. got: %s", body)
+	}
+}
+
+func TestValidate_Struct(t *testing.T) {
+	validate := NewValidate()
+	validate.RegisterStruct(defaultTopic, validateTestOrder{})
+
+	message, _ := newMockMessage(`{"name": "", "count": 0}`)
+	err := WrapContextHandler(validate).HandleMessage(defaultTopic, defaultChannel, message, nsqHandlerFuncSuccess)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("Validate.HandleMessage() error = %v, want *ValidationError", err)
+	}
+	if len(validationErr.Violations) != 2 || validationErr.Violations[0].Field != "validateTestOrder.Name" {
+		t.Errorf("violations = %+v", validationErr.Violations)
+	}
+
+	// Topics without a validator pass through.
+	message, _ = newMockMessage(`not json`)
+	if err := WrapContextHandler(validate).HandleMessage("other", defaultChannel, message, nsqHandlerFuncSuccess); err != nil {
+		t.Errorf("Validate.HandleMessage() error = %v", err)
+	}
+}